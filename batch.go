@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Abramovic/soundclouder/crawler"
+	"os"
+	"strconv"
+)
+
+func (c *Crawler) loadBatchSize() error {
+	if c.IsLocal() {
+		return c.LoadLocalBatchSize(c.Config.BatchSize)
+	}
+	if err := c.RegisterNamespace(); err != nil {
+		return err
+	}
+	r := c.RedisClient.Get()
+	defer r.Close()
+	return crawler.LoadBatchSize(r, c.Config.BatchSize)
+}
+
+// Re-buckets every hash, queue and schedule to a new batch size. All of the workers should be
+// stopped first ("./soundclouder control drain").
+func (c *Crawler) rebatch(arg string) {
+	size, err := strconv.Atoi(arg)
+	if err != nil || size <= 0 {
+		fmt.Println("usage: soundclouder rebatch <batch size>")
+		os.Exit(1)
+	}
+	r := c.RedisClient.Get()
+	defer r.Close()
+
+	workers, err := crawler.ListWorkers(r)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, worker := range workers {
+		if !worker.Silent && worker.Fields["status"] != "stopped" && !*force {
+			fmt.Printf("Worker %s is still %s. Drain the workers first or use -force=true.\n", worker.Id, worker.Fields["status"])
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("Changing the batch size from %d to %d\n", crawler.BatchSize, size)
+	err = crawler.Rebatch(r, size, func(key string) {
+		fmt.Println("Re-bucketed", key)
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
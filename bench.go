@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// "./soundclouder bench 10000" writes made up tracks into Redis the way the workers do, once
+// without pipelining and once with the configured pipeline, and prints the throughput of both.
+// Everything it writes is under "bench:" and deleted again afterwards.
+func (c *Crawler) bench(arg string) {
+	n := 10000
+	if arg != "" {
+		v, err := strconv.Atoi(arg)
+		if err != nil || v <= 0 {
+			fmt.Println("usage: soundclouder bench [tracks]")
+			os.Exit(1)
+		}
+		n = v
+	}
+	workers := max_workers
+	if workers > 50 {
+		workers = 50
+	}
+	pipelines := []int{1, c.Config.PipelineSize()}
+	if pipelines[1] == 1 {
+		pipelines = pipelines[:1]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PIPELINE\tTRACKS\tWORKERS\tSECONDS\tTRACKS/SEC")
+	for _, pipeline := range pipelines {
+		if err := c.ClearBench(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		elapsed, err := c.BenchStore(n, workers, pipeline)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%.2f\t%.0f\n", pipeline, n, workers, elapsed.Seconds(), float64(n)/elapsed.Seconds())
+	}
+	w.Flush()
+	if err := c.ClearBench(); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -7,26 +7,55 @@ import (
 	"github.com/Abramovic/soundclouder/config"
 	"github.com/Abramovic/soundclouder/crawler"
 	"github.com/Abramovic/soundclouder/helpers"
+	"github.com/Abramovic/soundclouder/models"
+	"github.com/Abramovic/soundclouder/store"
 	"github.com/garyburd/redigo/redis"
 	"os"
 	"os/signal"
 	"runtime"
-	"strconv"
-	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 var (
-	max_workers  int = 200
-	playlist_ids chan int
-	track_ids    chan int
-	maxPlaylist  = flag.Int("playlist", 40000000, "max playlist id") // We can't automatically grab the max playlist id
-	useEmpty     = flag.Bool("empty", true, "use empty database")
-	configFile   = flag.String("config", "", "path to config file")
-	restartTodo  = flag.Bool("restart", false, "restart incomplete crawls due to a crash")
+	max_workers int = 200
+	maxPlaylist     = flag.Int("playlist", 40000000, "max playlist id") // We can't automatically grab the max playlist id
+	useEmpty        = flag.Bool("empty", true, "use empty database")
+	configFile      = flag.String("config", "", "path to config file")
+	restartTodo     = flag.Bool("restart", false, "restart incomplete crawls due to a crash")
+	continuous      = flag.Bool("continuous", false, "never stop crawling and recrawl tracks and playlists on a schedule")
+	force           = flag.Bool("force", false, "seed the crawl again even if it was already seeded, or rebatch while workers are running")
+	fromId          = flag.Int("from", 0, "only seed and crawl ids from this one up")
+	toId            = flag.Int("to", 0, "only seed and crawl ids up to this one")
+	shard           = flag.String("shard", "", "only seed and crawl one shard of the batches (i/n)")
+	only            = flag.String("only", "", "only crawl \"tracks\" or \"playlists\"")
+	maxRequests     = flag.Int64("max-requests", 0, "stop after this many API requests (overrides max_requests)")
+	maxBatches      = flag.Int64("max-batches", 0, "stop after this many batches (overrides max_batches)")
+	maxDuration     = flag.String("max-duration", "", "stop after this long, e.g. \"6h\" (overrides max_duration)")
+	sampleRate      = flag.Float64("sample-rate", 0.001, "share of ids (or batches) to crawl with the sample command")
+	sampleBy        = flag.String("sample-by", "ids", "sample random \"ids\" or whole \"batches\"")
 )
 
+// The part of the ids this run is limited to (everything by default)
+var selection crawler.Selector
+
+var (
+	// Closed once we receive an exit signal so that any goroutine waiting to hand out work can stop.
+	stopping = make(chan struct{})
+	stopOnce sync.Once
+)
+
+// True once we're stopping. The channel is the only flag, so every goroutine can check it safely.
+func stopped() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
 /*
 
 	NOTES:
@@ -60,20 +89,138 @@ func main() {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	if config.Host == "" || config.ClientId == "" {
-		fmt.Println("Missing Configs", config)
+	// A single machine crawl with "storage": "bolt" doesn't need a Redis host and with Sentinel
+	// the host comes from the sentinels. "sqlite" only moves the graph, the queues are still in
+	// Redis so it needs a host too. The config isn't printed since it can hold passwords.
+	if (config.Host == "" && len(config.Sentinels) == 0 && config.Storage != "bolt") || config.ClientId == "" {
+		fmt.Println("Missing Configs: host (or sentinels) and client_id are required")
 		os.Exit(1)
 	}
 
+	if config.Namespace != "" {
+		if err := crawler.ValidNamespace(config.Namespace); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
 	if config.MaxWorkers > 0 {
 		max_workers = config.MaxWorkers
 	}
+	if *maxRequests > 0 {
+		config.MaxRequests = *maxRequests
+	}
+	if *maxBatches > 0 {
+		config.MaxBatches = *maxBatches
+	}
+	if *maxDuration != "" {
+		config.MaxDuration = *maxDuration
+	}
 
 	c := crawler.New(config)
+	if err := c.OpenStore(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	defer c.Close()
 
 	crawler := Crawler{c}
 
+	// "./soundclouder namespace list" lists, copies and deletes the crawls sharing this Redis.
+	if flag.Arg(0) == "namespace" {
+		crawler.needsRedis("namespace")
+		crawler.namespace(flag.Args()[1:])
+		return
+	}
+
+	// Every worker sharing this Redis has to agree on the batch size
+	if err := crawler.loadBatchSize(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// "./soundclouder rebatch 500" moves the whole crawl over to a new batch size.
+	if flag.Arg(0) == "rebatch" {
+		crawler.needsRedis("rebatch")
+		crawler.rebatch(flag.Arg(1))
+		return
+	}
+	// "./soundclouder migrate-edges varint" converts the stored edge lists to another format.
+	if flag.Arg(0) == "migrate-edges" {
+		crawler.needsRedisGraph("migrate-edges")
+		crawler.migrateEdges(flag.Arg(1))
+		return
+	}
+	// "./soundclouder migrate-models msgpack" converts the stored tracks and users to another format.
+	if flag.Arg(0) == "migrate-models" {
+		crawler.needsRedisGraph("migrate-models")
+		crawler.migrateModels(flag.Arg(1))
+		return
+	}
+	// "./soundclouder model-report" measures how much room the tracks and users take in each format.
+	if flag.Arg(0) == "model-report" {
+		crawler.needsRedisGraph("model-report")
+		crawler.modelReport(flag.Arg(1))
+		return
+	}
+
+	// A run limited to a range or shard gets queues of its own so the rest of the crawl is left alone
+	selection, err = parseSelection()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if selection.IsSet() {
+		if *continuous {
+			fmt.Println("-from, -to and -shard can't be used with -continuous")
+			os.Exit(1)
+		}
+		c.TrackQueue = c.NewQueue("tracks", selection)
+		c.PlaylistQueue = c.NewQueue("playlists", selection)
+	}
+
+	// "./soundclouder bench" measures how fast the workers can write into Redis.
+	if flag.Arg(0) == "bench" {
+		crawler.needsRedis("bench")
+		crawler.bench(flag.Arg(1))
+		return
+	}
+
+	// "./soundclouder control pause" sends a command to every worker and exits.
+	if flag.Arg(0) == "control" {
+		crawler.needsRedis("control")
+		crawler.control(flag.Args()[1:])
+		return
+	}
+	// "./soundclouder workers" lists every worker connected to this Redis.
+	if flag.Arg(0) == "workers" {
+		crawler.needsRedis("workers")
+		crawler.workers()
+		return
+	}
+
+	// "./soundclouder sample-report" prints the estimates from the last sample crawl.
+	if flag.Arg(0) == "sample-report" {
+		crawler.needsRedis("sample-report")
+		crawler.sampleReport()
+		return
+	}
+
+	// "./soundclouder schema" shows the layout version, "schema migrate" brings it up to date.
+	if flag.Arg(0) == "schema" {
+		crawler.needsRedis("schema")
+		crawler.schema(flag.Arg(1))
+		return
+	}
+	if !c.IsLocal() {
+		crawler.checkSchema()
+	}
+	// "./soundclouder reconcile" checks the trackCount* counters against the edge lists.
+	if flag.Arg(0) == "reconcile" {
+		crawler.needsRedisGraph("reconcile")
+		crawler.reconcile(flag.Arg(1))
+		return
+	}
+
 	// We are able to get the highest track id on our own.
 	max_id, err := crawler.GetHighTrackId()
 	if err != nil {
@@ -81,65 +228,88 @@ func main() {
 		os.Exit(1)
 	}
 
+	// "./soundclouder seed" only seeds the crawl and exits without crawling anything.
+	if flag.Arg(0) == "seed" {
+		if selection.IsSet() {
+			crawler.seedSelection(max_id)
+			return
+		}
+		if err := c.Seed(max_id, *maxPlaylist, *force); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Handle signals to stop crawling.
-	var canCrawl bool = true
 	stopCrawler := make(chan os.Signal, 1)
 	signal.Notify(stopCrawler, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-stopCrawler
-		fmt.Println("Exit signal recieved. Will finish up current crawls and exit the program.")
-		canCrawl = false
-		close(track_ids)
-		close(playlist_ids)
+		crawler.stop("Exit signal recieved.")
 	}()
 
-	track_ids = make(chan int, max_workers)
-	var trackMonitor sync.WaitGroup
-	trackMonitor.Add(max_workers)
-	for i := 0; i < max_workers; i++ {
-		go crawler.ProcessTracks(&trackMonitor)
+	// The time budget also has to stop us when no batch is being handed out (e.g. in continuous mode)
+	if !c.Budget.Deadline.IsZero() {
+		time.AfterFunc(time.Until(c.Budget.Deadline), func() {
+			crawler.stop("Ran out of time.")
+		})
+	}
+
+	if c.IsLocal() {
+		// Nobody else to tell about our concurrency or to send us control commands
+		go c.Concurrency.Run(c.Config.Adjust(), stopping, func(target int) {
+			fmt.Println("Concurrency target is now", target)
+		})
+	} else {
+		go c.Concurrency.Run(c.Config.Adjust(), stopping, crawler.publishConcurrency)
+		crawler.publishConcurrency(c.Concurrency.Target())
+		go c.WatchControl(stopping, crawler.handleControl)
+		go c.Heartbeat(crawler.status)
+		defer c.Deregister()
+	}
+
+	// "./soundclouder sample" crawls a random sample of the ids for quick estimates.
+	if flag.Arg(0) == "sample" {
+		crawler.needsRedis("sample")
+		crawler.sample(max_id)
+		return
+	}
+
+	// Starts a new crawl from scratch...
+	if *useEmpty == true && !stopped() {
+		if selection.IsSet() {
+			crawler.seedSelection(max_id)
+		} else {
+			crawler.seed(max_id)
+		}
 	}
 
 	r := c.RedisClient.Get()
 	defer r.Close()
 
 	// If we want to restart crawls due to a server crash...
-	if *restartTodo == true && *useEmpty == false && canCrawl {
-		playlists, _ := redis.Ints(r.Do("SMEMBERS", "crawlPlaylistsTodo"))
-		for _, i := range playlists {
-			r.Do("SADD", "crawlPlaylists", i)
-		}
-		tracks, _ := redis.Ints(r.Do("SMEMBERS", "crawlPlaylistsTodo"))
-		for _, i := range tracks {
-			r.Do("SADD", "crawlTracks", i)
-		}
+	if *restartTodo == true && *useEmpty == false && !stopped() {
+		c.PlaylistQueue.Restart(r)
+		c.TrackQueue.Restart(r)
 	}
 
-	// Starts a new crawl from scratch...
-	if *useEmpty == true && canCrawl {
-		r.Do("DEL", "crawlTracks")
-		batch_max := int(max_id/1000) + 1
-		for i := batch_max; i > 0; i-- {
-			nulls := []interface{}{fmt.Sprintf("trackMeta:%d", i)}
-			track_id := i * 1000
-			for k := 999; k >= 0; k-- {
-				nulls = append(nulls, fmt.Sprintf("%d", (track_id+k)), "null")
-			}
-			r.Do("HMSET", nulls...)
-			r.Do("SADD", "crawlTracks", i)
-		}
+	if *continuous {
+		crawler.needsRedis("-continuous")
+		crawler.RunContinuous(r)
+		return
 	}
 
-	var hasMoreTracks bool = true
-	for hasMoreTracks && canCrawl {
-		// Add all of the tracks that are scheduled to be crawled into a channel
-		i, err := redis.Int(r.Do("SPOP", "crawlTracks"))
-		if err != nil {
-			hasMoreTracks = false
-		} else {
-			r.Do("SADD", "crawlTracksTodo", i)
-			track_ids <- i
-		}
+	track_ids := make(chan int, max_workers)
+	var trackMonitor sync.WaitGroup
+	trackMonitor.Add(max_workers)
+	for i := 0; i < max_workers; i++ {
+		go crawler.ProcessTracks(track_ids, &trackMonitor)
+	}
+
+	// Add all of the tracks that are scheduled to be crawled into a channel
+	if *only != "playlists" {
+		crawler.feed(r, c.TrackQueue, track_ids, 0)
 	}
 	close(track_ids)
 	// Wait for all of the tracks to be crawled before going onto the playlists
@@ -148,43 +318,139 @@ func main() {
 	// Manually run garbage collection to free up any memory that is no longer used
 	runtime.GC()
 
-	playlist_ids = make(chan int, max_workers)
+	playlist_ids := make(chan int, max_workers)
 	var playlistMonitor sync.WaitGroup
 	playlistMonitor.Add(max_workers)
 	for i := 0; i < max_workers; i++ {
-		go crawler.ProcessPlaylists(&playlistMonitor)
-	}
-	if *useEmpty == true && canCrawl {
-		r.Do("DEL", "crawlPlaylists")
-		playlist_max := int(*maxPlaylist/1000) + 1
-		for i := playlist_max; i > 0; i-- {
-			nulls := []interface{}{fmt.Sprintf("playlistTracks:%d", i)}
-			playlist_id := i * 1000
-			for k := 999; k >= 0; k-- {
-				nulls = append(nulls, fmt.Sprintf("%d", (playlist_id+k)), "null")
+		go crawler.ProcessPlaylists(playlist_ids, &playlistMonitor)
+	}
+	if *only != "tracks" {
+		crawler.feed(r, c.PlaylistQueue, playlist_ids, 0)
+	}
+	close(playlist_ids)
+	playlistMonitor.Wait()
+}
+
+// Hands out batches from the queue to the workers until the queue is empty, we handed out limit
+// batches (0 for no limit) or we are stopping. Returns how many batches were handed out.
+func (c *Crawler) feed(r redis.Conn, queue crawler.Queue, ids chan int, limit int) int {
+	n := 0
+	for !stopped() && (limit == 0 || n < limit) {
+		i, err := queue.Pop(r)
+		if err != nil {
+			if err != crawler.ErrQueueEmpty {
+				fmt.Println(err)
 			}
-			r.Do("HMSET", nulls...)
-			r.Do("SADD", "crawlPlaylists", i)
+			break
+		}
+		select {
+		case ids <- i:
+			n++
+		case <-stopping:
+			// Nobody is going to crawl it in this run
+			c.requeue(r, queue, i)
 		}
 	}
+	return n
+}
 
-	var hasMorePlaylists bool = true
-	for hasMorePlaylists && canCrawl {
-		i, err := redis.Int(r.Do("SPOP", "crawlPlaylists"))
+// Puts a batch that was handed out but never started back onto the queue.
+func (c *Crawler) requeue(r redis.Conn, queue crawler.Queue, batch_id int) {
+	if err := queue.Requeue(r, batch_id); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Graceful exit: no new batches are handed out and the workers finish up the batch they are on.
+func (c *Crawler) stop(reason string) {
+	stopOnce.Do(func() {
+		fmt.Println(reason, "Will finish up current crawls and exit the program.")
+		close(stopping)
+		c.Concurrency.Stop()
+	})
+}
+
+// Lets operators see the current concurrency target of every worker
+func (c *Crawler) publishConcurrency(target int) {
+	fmt.Println("Concurrency target is now", target)
+	r := c.RedisClient.Get()
+	defer r.Close()
+	r.Do("HSET", crawler.Key(crawler.ConcurrencyTargets), crawler.WorkerId(), target)
+}
+
+// Exits if this crawl runs without Redis since what we were asked to do only works with Redis.
+// "storage": "sqlite" still has Redis.
+func (c *Crawler) needsRedis(what string) {
+	if c.IsLocal() {
+		fmt.Println(what, "needs Redis and can't be used with \"storage\": \"bolt\"")
+		os.Exit(1)
+	}
+}
+
+// Exits unless the graph is kept in the Redis hashes since what we were asked to do works on them.
+func (c *Crawler) needsRedisGraph(what string) {
+	if !c.GraphInRedis() {
+		fmt.Printf("%s works on the graph in Redis and can't be used with \"storage\": %q\n", what, c.Config.Storage)
+		os.Exit(1)
+	}
+}
+
+// Seeding is skipped (and not treated as an error) when another worker already seeded the crawl
+// so starting a second worker with the default flags doesn't wipe out the first one.
+func (c *Crawler) seed(max_id int) {
+	err := c.Seed(max_id, *maxPlaylist, *force)
+	switch err {
+	case nil:
+		fmt.Println("Seeded a new crawl.")
+	case crawler.ErrAlreadySeeded, crawler.ErrSeedLocked:
+		fmt.Println(err, "- continuing with the pending crawls.")
+	default:
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func parseSelection() (crawler.Selector, error) {
+	sel := crawler.Selector{From: *fromId, To: *toId}
+	if *only != "" && *only != "tracks" && *only != "playlists" {
+		return sel, fmt.Errorf("-only has to be \"tracks\" or \"playlists\"")
+	}
+	if sel.To > 0 && sel.To < sel.From {
+		return sel, fmt.Errorf("-to has to be bigger than -from")
+	}
+	if *shard != "" {
+		i, n, err := crawler.ParseShard(*shard)
 		if err != nil {
-			hasMorePlaylists = false
-		} else {
-			r.Do("SADD", "crawlPlaylistsTodo", i)
-			playlist_ids <- i
+			return sel, err
 		}
+		sel.Shard, sel.Shards = i, n
 	}
-	close(playlist_ids)
-	playlistMonitor.Wait()
+	return sel, nil
 }
 
-func (c *Crawler) ProcessPlaylists(wg *sync.WaitGroup) error {
+// Seeds only the ids in the selection and queues their batches on the selection's own queues.
+func (c *Crawler) seedSelection(max_id int) {
+	if *only != "playlists" {
+		if err := c.SeedSelection(store.Tracks, c.TrackQueue, selection, max_id); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if *only != "tracks" {
+		if err := c.SeedSelection(store.Playlists, c.PlaylistQueue, selection, *maxPlaylist); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	fmt.Println("Seeded", selection)
+}
+
+// Crawls the playlist batches handed out on playlist_ids until the channel is closed.
+func (c *Crawler) ProcessPlaylists(playlist_ids <-chan int, wg *sync.WaitGroup) error {
 	r := c.RedisClient.Get()
 	defer r.Close()
+	g := c.Graph()
+	defer g.Close()
 P:
 	for {
 		select {
@@ -192,63 +458,138 @@ P:
 			if !open {
 				break P
 			}
-			// Get all of the IDs in this batch of 1,000 playlists
-			ids, err := redis.Strings(r.Do("HKEYS", fmt.Sprintf("playlistTracks:%d", batch_id)))
+			// Get all of the IDs in this batch of playlists (1,000 unless batch_size says otherwise)
+			first, last := crawler.BatchRange(batch_id)
+			ids, err := g.Ids(store.Playlists, first, last)
 			if err != nil {
 				fmt.Println(err)
 				continue
 			}
-			for _, id := range ids {
-				// CLEANUP Go's string to int is string to int64 and then we are turning the int64 into an int
-				pid, err := strconv.ParseInt(id, 0, 64)
+			// Stop the same way as an exit signal once this run has used up its budget
+			if reason, ok := c.Budget.Take(); !ok {
+				c.stop(reason)
+			}
+			// Wait until the adaptive concurrency lets us crawl another batch. If we are shutting down
+			// the batch goes back onto the queue for the next run.
+			if !c.Concurrency.Acquire() {
+				c.requeue(r, c.PlaylistQueue, batch_id)
+				continue
+			}
+			c.Stats.StartBatch("playlists", batch_id)
+			// Batches in a dead region are only probed. The probes go first and if one of them is
+			// live we crawl the rest of the batch too.
+			sparse, pass := c.DeadPlaylists.Probing(r, batch_id)
+			if sparse {
+				ids = c.DeadPlaylists.ProbesFirst(ids, pass)
+			}
+			checked, hits := 0, 0
+			var failed error
+			for _, playlist_id := range ids {
+				if !selection.HasId(playlist_id) {
+					// This id is outside of the range or shard we were asked to crawl
+					continue
+				}
+				c.Stats.Item()
+				pending, err := g.IsPending(store.Playlists, playlist_id)
 				if err != nil {
+					// We can't tell, so the batch isn't acked and gets crawled again
+					fmt.Println(err)
+					failed = err
 					continue
 				}
-				playlist_id := int(pid)
-				key, hkey := crawler.RedisKey("playlistTracks", playlist_id)
-				exists, _ := redis.Bool(r.Do("HEXISTS", key, hkey))
-				if exists == false {
-					// we can't crawl this record because it was deleted before in a past crawl.
+				if !pending {
+					// we never saw this id
 					continue
 				}
+				dead, due := c.Recheck(g, store.Playlists, playlist_id, time.Now())
+				if dead && !due {
+					// It was dead the last time we looked and the recheck policy says to leave it for now.
+					// It still counts as a miss for the dead ranges, otherwise a batch that is all
+					// tombstones never looks dead.
+					checked++
+					continue
+				}
+				if *continuous && !dead && !crawler.IsDue(g, store.Playlists, playlist_id, time.Now()) {
+					// We crawled this playlist recently and it isn't due yet. It's live as far as the
+					// dead ranges are concerned.
+					hits++
+					continue
+				}
+				if sparse && hits == 0 && !c.DeadPlaylists.IsProbe(playlist_id, pass) {
+					// Leave it as pending so a later pass can probe it
+					continue
+				}
+				checked++
 				playlist, err := c.GetPlaylist(playlist_id)
 				if err != nil {
-					// We can't crawl this record. Make sure we delete it from our database.
-					r.Do("HDEL", key, hkey)
+					if err == crawler.ErrUnauthorized || err == crawler.ErrOverBudget {
+						// Every other request will fail the same way, so stop and leave the batch unacked
+						c.stop(err.Error())
+						failed = err
+						break
+					}
+					// Only bury it if SoundCloud told us it's gone, anything else is tried again next time
+					if reason, ok := crawler.DeadReason(err); ok {
+						c.Bury(g, store.Playlists, playlist_id, reason, time.Now())
+					}
 					continue
 				}
-				track_ids := []string{}
+				track_ids := []int{}
 				for _, track := range playlist.Tracks {
-					// AppendSlice keeps a unique slice in case the playlist has the same track multiple times
-					track_ids = helpers.AppendSlice(track_ids, fmt.Sprintf("%d", track.Id))
+					// AppendInt keeps a unique slice in case the playlist has the same track multiple times
+					track_ids = helpers.AppendInt(track_ids, track.Id)
 				}
 				if len(track_ids) == 0 {
 					// This playlist doesn't have any tracks associated with it
-					r.Do("HDEL", key, hkey)
+					c.Bury(g, store.Playlists, playlist_id, store.DeadEmpty, time.Now())
 					continue
 				}
-				// If this is the first time that we have seen this playlist (empty string or "null") then we
-				// want to increment the counter for each track in the playlist
-				s, _ := redis.String(r.Do("HGET", key, hkey))
-				if s == "null" || s == "" {
-					for _, track := range playlist.Tracks {
-						// Increment the counter for the tracks, not the playlist
-						k, h := crawler.RedisKey("trackCountPlaylist", track.Id)
-						r.Do("HINCRBY", k, h, 1)
+				if dead {
+					if err := c.Revive(g, store.Playlists, playlist_id); err != nil {
+						fmt.Println(err)
+						failed = err
+						continue
 					}
 				}
-				r.Do("HSET", key, hkey, strings.Join(track_ids, ","))
+				// Every track that is new in this playlist has its playlist counter incremented and every
+				// track that was removed since the last crawl has it decremented
+				if _, _, err := g.PutEdges(store.PlaylistTracks, playlist_id, track_ids); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				c.MarkCrawled(g, store.Playlists, playlist_id, len(track_ids), time.Now())
+				hits++
+			}
+			c.DeadPlaylists.Record(r, batch_id, checked, hits)
+			if *continuous {
+				crawler.ScheduleNextBatch(r, g, crawler.PlaylistSchedule, store.Playlists, batch_id, c.Config.Retry())
+			}
+			// Everything from this batch has to be stored before the batch is acked. If it isn't
+			// the batch stays in progress so it gets crawled again after a restart.
+			err = g.Flush()
+			if err == store.ErrCommitFailed {
+				// Every batch in progress lost its writes, nothing can be acked until a restart
+				c.stop(err.Error())
+			} else if err != nil {
+				fmt.Println(err)
+			}
+			c.Stats.FinishBatch("playlists", batch_id)
+			c.Concurrency.Release()
+			if err == nil && failed == nil {
+				c.PlaylistQueue.Ack(r, batch_id)
 			}
-			r.Do("SREM", "crawlPlaylistsTodo", batch_id)
 		}
 	}
 	wg.Done()
 	return nil
 }
 
-func (c *Crawler) ProcessTracks(wg *sync.WaitGroup) error {
+// Crawls the track batches handed out on track_ids until the channel is closed.
+func (c *Crawler) ProcessTracks(track_ids <-chan int, wg *sync.WaitGroup) error {
 	r := c.RedisClient.Get()
 	defer r.Close()
+	g := c.Graph()
+	defer g.Close()
 T:
 	for {
 		select {
@@ -256,94 +597,151 @@ T:
 			if !open {
 				break T
 			}
-			// Grab the batch of tracks to be crawled (up to 1,000)
-			ids, err := redis.Strings(r.Do("HKEYS", fmt.Sprintf("trackMeta:%d", batch_id)))
+			// Grab the batch of tracks to be crawled (up to batch_size)
+			first, last := crawler.BatchRange(batch_id)
+			ids, err := g.Ids(store.Tracks, first, last)
 			if err != nil {
 				fmt.Println(err)
 				continue
 			}
-			for _, id := range ids {
-				tid, err := strconv.ParseInt(id, 0, 64)
-				if err != nil {
+			// Stop the same way as an exit signal once this run has used up its budget
+			if reason, ok := c.Budget.Take(); !ok {
+				c.stop(reason)
+			}
+			// Wait until the adaptive concurrency lets us crawl another batch. If we are shutting down
+			// the batch goes back onto the queue for the next run.
+			if !c.Concurrency.Acquire() {
+				c.requeue(r, c.TrackQueue, batch_id)
+				continue
+			}
+			c.Stats.StartBatch("tracks", batch_id)
+			// Batches in a dead region are only probed. The probes go first and if one of them is
+			// live we crawl the rest of the batch too.
+			sparse, pass := c.DeadTracks.Probing(r, batch_id)
+			if sparse {
+				ids = c.DeadTracks.ProbesFirst(ids, pass)
+			}
+			checked, hits := 0, 0
+			var failed error
+			for _, track_id := range ids {
+				if !selection.HasId(track_id) {
+					// This id is outside of the range or shard we were asked to crawl
 					continue
 				}
-				track_id := int(tid)
+				c.Stats.Item()
 
-				key, hkey := crawler.RedisKey("trackMeta", track_id)
-				exists, _ := redis.Bool(r.Do("HEXISTS", key, hkey))
-				if exists == false {
-					// we can't crawl this record because it was deleted before in a past crawl.
+				pending, err := g.IsPending(store.Tracks, track_id)
+				if err != nil {
+					// We can't tell, so the batch isn't acked and gets crawled again
+					fmt.Println(err)
+					failed = err
+					continue
+				}
+				if !pending {
+					// we never saw this id
+					continue
+				}
+				dead, due := c.Recheck(g, store.Tracks, track_id, time.Now())
+				if dead && !due {
+					checked++
+					continue
+				}
+				if *continuous && !dead && !crawler.IsDue(g, store.Tracks, track_id, time.Now()) {
+					hits++
 					continue
 				}
+				if sparse && hits == 0 && !c.DeadTracks.IsProbe(track_id, pass) {
+					continue
+				}
+				checked++
 				track, err := c.GetTrack(track_id)
 				if err != nil {
-					// We can't crawl this record. Make sure we delete it from our database.
-					r.Do("HDEL", key, hkey)
+					if err == crawler.ErrUnauthorized || err == crawler.ErrOverBudget {
+						c.stop(err.Error())
+						failed = err
+						break
+					}
+					if reason, ok := crawler.DeadReason(err); ok {
+						c.Bury(g, store.Tracks, track_id, reason, time.Now())
+					}
 					continue
 				}
-				j, err := json.Marshal(track)
-				if err != nil {
-					r.Do("HDEL", key, hkey)
+				if err := g.PutTrack(track); err != nil {
+					// Our problem, not SoundCloud's, so the track isn't dead
+					fmt.Println(err)
 					continue
 				}
-				r.Do("HSET", key, hkey, string(j))
-				if track.User.Id > 0 {
-					// Store the user meta data if available
-					userKey, userHkey := crawler.RedisKey("userMeta", track.User.Id)
-					s, _ := redis.String(r.Do("HGET", userKey, userHkey))
-					if s == "null" || s == "" {
-						// Only update the user data if this is the first time that we have seen them
-						j, err := json.Marshal(track.User)
-						if err != nil {
-							continue
-						}
-						r.Do("HSET", userKey, userHkey, string(j))
+				if dead {
+					if err := c.Revive(g, store.Tracks, track_id); err != nil {
+						fmt.Println(err)
+						failed = err
+						continue
 					}
 				}
+				hits++
+				if track.User.Id > 0 {
+					// Store the user meta data if available. Only the first time that we have seen them.
+					g.PutUser(track.User)
+				}
 
-				// Get all of the comments on this track
-				comments := c.GetTrackComments(track.Id)
-				// Transform all of the User Ids from ints into strings
-				track_commenters := []string{}
-				for _, comment := range comments {
-					// AppendSlice will only append to the slice if the user id does not already exist
-					track_commenters = helpers.AppendSlice(track_commenters, fmt.Sprintf("%d", comment.UserId))
+				// Get all of the comments and the users who have favorited this track. If either of them fails
+				// the edges are left alone (a short list would remove edges) and the batch is tried again.
+				comments, err := c.GetTrackComments(track.Id)
+				var favoriters []models.Favoriter
+				if err == nil {
+					favoriters, err = c.GetTrackFavoriters(track.Id)
 				}
-				if len(track_commenters) > 0 {
-					comKey, comHkey := crawler.RedisKey("trackCommenters", track_id)
-					// If this is the first time that we have seen this track (empty string or "null") then we
-					// want to increment the counter of the number of user commenters that we have seen
-					s, _ := redis.String(r.Do("HGET", comKey, comHkey))
-					if s == "null" || s == "" {
-						for range track_commenters {
-							k, h := crawler.RedisKey("trackCountCommenters", track_id)
-							r.Do("HINCRBY", k, h, 1)
-						}
+				if err != nil {
+					fmt.Println(err)
+					failed = err
+					if err == crawler.ErrUnauthorized || err == crawler.ErrOverBudget {
+						c.stop(err.Error())
+						break
 					}
-					r.Do("HSET", comKey, comHkey, strings.Join(track_commenters, ","))
+					continue
 				}
-				// Get all of the users who have favorited this track
-				favoriters := c.GetTrackFavoriters(track.Id)
-				// Transform the User IDs from a slice of ints to a slice of strings
-				track_favoriters := []string{}
+				track_commenters := []int{}
+				for _, comment := range comments {
+					// AppendInt will only append to the slice if the user id does not already exist
+					track_commenters = helpers.AppendInt(track_commenters, comment.UserId)
+				}
+				// The number of commenters moves by however many were added or removed since the last crawl.
+				// An empty list counts too, everybody who commented before is gone.
+				if _, _, err := g.PutEdges(store.TrackCommenters, track_id, track_commenters); err != nil {
+					fmt.Println(err)
+					failed = err
+					continue
+				}
+				track_favoriters := []int{}
 				for _, favorite := range favoriters {
-					track_favoriters = append(track_favoriters, fmt.Sprintf("%d", favorite.Id))
+					track_favoriters = append(track_favoriters, favorite.Id)
 				}
-				if len(track_favoriters) > 0 {
-					favKey, favHkey := crawler.RedisKey("trackFavoriters", track_id)
-					// If this is the first time that we have seen this track (empty string or "null") then we
-					// want to increment the counter of the number of user favorites that we have seen
-					s, _ := redis.String(r.Do("HGET", favKey, favHkey))
-					if s == "null" || s == "" {
-						for range track_favoriters {
-							k, h := crawler.RedisKey("trackCountFavoriters", track_id)
-							r.Do("HINCRBY", k, h, 1)
-						}
-					}
-					r.Do("HSET", favKey, favHkey, strings.Join(track_favoriters, ","))
+				// Same for the number of favoriters
+				if _, _, err := g.PutEdges(store.TrackFavoriters, track_id, track_favoriters); err != nil {
+					fmt.Println(err)
+					failed = err
+					continue
 				}
+				c.MarkCrawled(g, store.Tracks, track_id, len(track_commenters)+len(track_favoriters), time.Now())
+			}
+			c.DeadTracks.Record(r, batch_id, checked, hits)
+			if *continuous {
+				crawler.ScheduleNextBatch(r, g, crawler.TrackSchedule, store.Tracks, batch_id, c.Config.Retry())
+			}
+			// Everything from this batch has to be stored before the batch is acked. If it isn't
+			// the batch stays in progress so it gets crawled again after a restart.
+			err = g.Flush()
+			if err == store.ErrCommitFailed {
+				// Every batch in progress lost its writes, nothing can be acked until a restart
+				c.stop(err.Error())
+			} else if err != nil {
+				fmt.Println(err)
+			}
+			c.Stats.FinishBatch("tracks", batch_id)
+			c.Concurrency.Release()
+			if err == nil && failed == nil {
+				c.TrackQueue.Ack(r, batch_id)
 			}
-			r.Do("SREM", "crawlTracksTodo", batch_id)
 		}
 	}
 	wg.Done()
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"github.com/Abramovic/soundclouder/config"
+	"github.com/Abramovic/soundclouder/crawler"
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Answers every request with the body stored for its path, 404 for anything else
+type fakeAPI map[string]string
+
+func (f fakeAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := 200
+	body, ok := f[req.URL.Path]
+	if !ok {
+		status, body = 404, `{"errors":[{"error_message":"404 - Not Found"}]}`
+	}
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Header:     http.Header{},
+		Request:    req,
+	}, nil
+}
+
+// Remembers which batches were acked or requeued
+type fakeQueue struct {
+	mu       sync.Mutex
+	acked    []int
+	requeued []int
+}
+
+func (q *fakeQueue) Push(r redis.Conn, batch_id int) error { return nil }
+func (q *fakeQueue) Pop(r redis.Conn) (int, error)         { return 0, crawler.ErrQueueEmpty }
+func (q *fakeQueue) Restart(r redis.Conn) error            { return nil }
+
+func (q *fakeQueue) Ack(r redis.Conn, batch_id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.acked = append(q.acked, batch_id)
+	return nil
+}
+
+func (q *fakeQueue) Requeue(r redis.Conn, batch_id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.requeued = append(q.requeued, batch_id)
+	return nil
+}
+
+// A crawler that keeps the graph in g and talks to api instead of SoundCloud. There is no Redis,
+// every connection fails, so anything the workers still need Redis for is skipped.
+func testCrawler(g store.SharedStore, api fakeAPI) (*Crawler, *fakeQueue) {
+	c := crawler.New(config.Configuration{Host: "localhost", ClientId: "test", MaxWorkers: 2})
+	c.RedisClient = &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return nil, errors.New("no Redis in tests")
+		},
+	}
+	c.HttpClient = &http.Client{Transport: api}
+	c.BackOff = nil
+	c.UseGraph(g)
+	q := &fakeQueue{}
+	c.TrackQueue, c.PlaylistQueue = q, q
+	return &Crawler{c}, q
+}
+
+func TestProcessTracks(t *testing.T) {
+	g := store.NewMemoryStore()
+	g.AddPending(store.Tracks, []int{1, 2, 3})
+	c, q := testCrawler(g, fakeAPI{
+		"/tracks/1":            `{"id":1,"title":"one","user":{"id":7}}`,
+		"/tracks/1/comments":   `[{"id":10,"user_id":7},{"id":11,"user_id":8},{"id":12,"user_id":7}]`,
+		"/tracks/1/favoriters": `[{"id":8}]`,
+		"/tracks/3":            `{"id":3,"title":"three"}`,
+		"/tracks/3/comments":   `[]`,
+		"/tracks/3/favoriters": `[]`,
+	})
+
+	ids := make(chan int, 1)
+	ids <- 0
+	close(ids)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	c.ProcessTracks(ids, &wg)
+
+	for _, id := range []int{1, 3} {
+		if _, ok := g.Track(id); !ok {
+			t.Errorf("track %d wasn't stored", id)
+		}
+	}
+	if _, ok := g.Track(2); ok {
+		t.Errorf("track 2 was stored even though SoundCloud doesn't have it")
+	}
+	if ts, ok, _ := g.Tombstone(store.Tracks, 2); !ok || ts.Reason != store.DeadMissing {
+		t.Errorf("track 2 should be buried as missing, got %+v (dead %v)", ts, ok)
+	}
+	// The same commenter twice only counts once
+	if n := g.Counter(store.TrackCountCommenters, 1); n != 2 {
+		t.Errorf("track 1 has %d commenters, want 2", n)
+	}
+	if n := g.Counter(store.TrackCountFavoriters, 1); n != 1 {
+		t.Errorf("track 1 has %d favoriters, want 1", n)
+	}
+	if next, ok, _ := g.NextCrawl(store.Tracks, 1); !ok || next.IsZero() {
+		t.Errorf("track 1 has no next crawl")
+	}
+	if len(q.acked) != 1 || q.acked[0] != 0 {
+		t.Errorf("acked %v, want batch 0", q.acked)
+	}
+}
+
+func TestProcessPlaylists(t *testing.T) {
+	g := store.NewMemoryStore()
+	g.AddPending(store.Playlists, []int{5, 6})
+	c, q := testCrawler(g, fakeAPI{
+		"/playlists/5": `{"id":5,"tracks":[{"id":1},{"id":2},{"id":1}]}`,
+		"/playlists/6": `{"id":6,"tracks":[]}`,
+	})
+
+	ids := make(chan int, 1)
+	ids <- 0
+	close(ids)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	c.ProcessPlaylists(ids, &wg)
+
+	if edges := g.Edges(store.PlaylistTracks, 5); len(edges) != 2 {
+		t.Errorf("playlist 5 has tracks %v, want 1 and 2", edges)
+	}
+	for _, id := range []int{1, 2} {
+		if n := g.Counter(store.TrackCountPlaylist, id); n != 1 {
+			t.Errorf("track %d is in %d playlists, want 1", id, n)
+		}
+	}
+	if ts, ok, _ := g.Tombstone(store.Playlists, 6); !ok || ts.Reason != store.DeadEmpty {
+		t.Errorf("playlist 6 should be buried as empty, got %+v (dead %v)", ts, ok)
+	}
+	if len(q.acked) != 1 {
+		t.Errorf("acked %v, want batch 0", q.acked)
+	}
+}
+
+func TestProcessTracksKeepsEdgesWhenAPageFails(t *testing.T) {
+	g := store.NewMemoryStore()
+	g.AddPending(store.Tracks, []int{1})
+	g.PutEdges(store.TrackFavoriters, 1, []int{8, 9})
+	c, q := testCrawler(g, fakeAPI{
+		"/tracks/1":          `{"id":1,"title":"one"}`,
+		"/tracks/1/comments": `[]`,
+		// No favoriters page, it answers with a 404
+	})
+
+	ids := make(chan int, 1)
+	ids <- 0
+	close(ids)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	c.ProcessTracks(ids, &wg)
+
+	if edges := g.Edges(store.TrackFavoriters, 1); len(edges) != 2 {
+		t.Errorf("track 1 has favoriters %v, want 8 and 9", edges)
+	}
+	if _, ok, _ := g.NextCrawl(store.Tracks, 1); ok {
+		t.Errorf("track 1 was marked as crawled")
+	}
+	if len(q.acked) != 0 {
+		t.Errorf("acked %v, the batch has to be crawled again", q.acked)
+	}
+}
+
+func TestProcessPlaylistsCountsOnlyLiveLists(t *testing.T) {
+	g := store.NewMemoryStore()
+	g.AddPending(store.Playlists, []int{5})
+	g.PutEdges(store.PlaylistTracks, 5, []int{1, 2})
+	c, _ := testCrawler(g, fakeAPI{
+		"/playlists/5": `{"id":5,"tracks":[]}`,
+	})
+
+	crawl := func() {
+		ids := make(chan int, 1)
+		ids <- 0
+		close(ids)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		c.ProcessPlaylists(ids, &wg)
+	}
+	crawl()
+	if n := g.Counter(store.TrackCountPlaylist, 1); n != 0 {
+		t.Errorf("track 1 is in %d playlists after its playlist was emptied, want 0", n)
+	}
+	if edges := g.Edges(store.PlaylistTracks, 5); len(edges) != 2 {
+		t.Errorf("playlist 5 lost its tracks %v when it was buried", edges)
+	}
+
+	// The recheck finds it again with one track less
+	c.Config.Recheck = map[string]string{store.DeadEmpty: "1ns"}
+	c.HttpClient.Transport = fakeAPI{"/playlists/5": `{"id":5,"tracks":[{"id":1}]}`}
+	crawl()
+	if n := g.Counter(store.TrackCountPlaylist, 1); n != 1 {
+		t.Errorf("track 1 is in %d playlists, want 1", n)
+	}
+	if n := g.Counter(store.TrackCountPlaylist, 2); n != 0 {
+		t.Errorf("track 2 is in %d playlists, want 0", n)
+	}
+}
+
+// A MemoryStore whose commits fail like a SQLite file on a full disk
+type failingStore struct {
+	*store.MemoryStore
+}
+
+func (f failingStore) Flush() error { return store.ErrCommitFailed }
+
+func TestProcessTracksStopsWhenACommitFails(t *testing.T) {
+	t.Cleanup(func() {
+		stopping, stopOnce = make(chan struct{}), sync.Once{}
+	})
+	g := store.NewMemoryStore()
+	g.AddPending(store.Tracks, []int{1})
+	c, q := testCrawler(failingStore{g}, fakeAPI{
+		"/tracks/1":            `{"id":1,"title":"one"}`,
+		"/tracks/1/comments":   `[]`,
+		"/tracks/1/favoriters": `[]`,
+	})
+
+	ids := make(chan int, 1)
+	ids <- 0
+	close(ids)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	c.ProcessTracks(ids, &wg)
+
+	if len(q.acked) != 0 {
+		t.Errorf("acked %v even though the commit failed", q.acked)
+	}
+	select {
+	case <-stopping:
+	default:
+		t.Errorf("the crawl didn't stop")
+	}
+}
+
+// Always has another batch
+type endlessQueue struct {
+	fakeQueue
+}
+
+func (q *endlessQueue) Pop(r redis.Conn) (int, error) { return 1, nil }
+
+func TestFeedStopsWhenStopping(t *testing.T) {
+	t.Cleanup(func() {
+		stopping, stopOnce = make(chan struct{}), sync.Once{}
+	})
+	c, _ := testCrawler(store.NewMemoryStore(), fakeAPI{})
+	q := &endlessQueue{}
+	ids := make(chan int)
+	done := make(chan int)
+	go func() {
+		done <- c.feed(nil, q, ids, 0)
+	}()
+	for i := 0; i < 3; i++ {
+		<-ids
+	}
+	// Stops from another goroutine, like the signal handler does
+	halted := make(chan struct{})
+	go func() {
+		c.stop("test")
+		close(halted)
+	}()
+	if n := <-done; n < 3 {
+		t.Errorf("handed out %d batches, want at least 3", n)
+	}
+	<-halted
+}
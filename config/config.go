@@ -1,7 +1,223 @@
 package config
 
+import (
+	"time"
+)
+
 type Configuration struct {
-	Host       string `json:"host"`
+	Host string `json:"host"`
+	// The rest of the Redis connection. port defaults to 6379, password is sent with AUTH and
+	// database picks the database with SELECT. tls is for managed Redis that only talks TLS.
+	Port          int    `json:"port"`
+	Password      string `json:"password"`
+	Database      int    `json:"database"`
+	TLS           bool   `json:"tls"`
+	TLSSkipVerify bool   `json:"tls_skip_verify"`
+	// With sentinels set, host and port are ignored and the address of sentinel_master is asked
+	// from the sentinels every time a new connection is made, so a failover is picked up.
+	Sentinels        []string `json:"sentinels"`
+	SentinelMaster   string   `json:"sentinel_master"`
+	SentinelPassword string   `json:"sentinel_password"`
+	// For Redis Cluster. Every key gets the same hash tag so the whole crawl lives in one slot,
+	// which keeps MULTI, RENAME and the Lua scripts working.
+	Cluster bool `json:"cluster"`
+	// Put in front of every key so several crawls can share one Redis. Leave it empty for a
+	// crawl that was started before there were namespaces.
+	Namespace string `json:"namespace"`
+	// The Redis connection pool. Defaults are 1000 active, max_workers idle and a 1s idle timeout.
+	MaxActive   int    `json:"max_active"`
+	MaxIdle     int    `json:"max_idle"`
+	IdleTimeout string `json:"idle_timeout"`
+
 	ClientId   string `json:"client_id"`
 	MaxWorkers int    `json:"max_workers"`
+	// When adaptive is on, max_workers is the ceiling and the number of batches being crawled
+	// at once moves between min_workers and max_workers depending on how SoundCloud responds.
+	Adaptive       bool    `json:"adaptive"`
+	MinWorkers     int     `json:"min_workers"`
+	StartWorkers   int     `json:"start_workers"`
+	WorkerStep     int     `json:"worker_step"`
+	MaxLatency     string  `json:"max_latency"`
+	MaxErrorRate   float64 `json:"max_error_rate"`
+	AdjustInterval string  `json:"adjust_interval"`
+	// How many ids go into one Redis hash and one unit of work. Only used when a crawl is started,
+	// after that the size stored in Redis wins (see the rebatch command).
+	BatchSize int `json:"batch_size"`
+	// "set" (default) or "stream" to hand out batches with Redis Streams consumer groups
+	Queue string `json:"queue"`
+	// How long a batch can sit unacked in the stream before another worker takes it over
+	ClaimAfterIdle string `json:"claim_after"`
+	// A batch that came back without a single hit dead_after passes in a row is only probed
+	// every probe_every ids from then on.
+	DeadAfter  int `json:"dead_after"`
+	ProbeEvery int `json:"probe_every"`
+	// Budgets for a single run. Once one of them is used up the worker finishes the batches it
+	// is on and exits, leaving the rest of the queue for the next run. Zero means no limit.
+	MaxRequests int64  `json:"max_requests"`
+	MaxBatches  int64  `json:"max_batches"`
+	MaxDuration string `json:"max_duration"`
+	// How often the continuous crawler checks for new tracks and playlists above the frontier
+	PollInterval string        `json:"poll_interval"`
+	RecrawlTiers []RecrawlTier `json:"recrawl_tiers"`
+	// How long the continuous crawler waits before it tries a batch again that has nothing
+	// scheduled in it, e.g. because every request failed
+	RetryInterval string `json:"retry_interval"`
+	// Where the graph goes. "redis" (default), "bolt" for a single machine crawl that keeps
+	// everything in one file at storage_path and doesn't need Redis at all, or "sqlite" to write
+	// the graph into a SQLite file at storage_path while the queues stay in Redis.
+	Storage     string `json:"storage"`
+	StoragePath string `json:"storage_path"`
+	// How many Redis writes a worker queues up before sending them in one round trip. 1 turns
+	// pipelining off.
+	Pipeline int `json:"pipeline"`
+	// How edge lists are stored in Redis: "csv" (default), "varint" or "varint-deflate". Lists in
+	// any of them can be read, see the migrate-edges command.
+	EdgeFormat string `json:"edge_format"`
+	// How tracks and users are stored in Redis: "json" (default), "msgpack" or "msgpack-deflate".
+	// Values in any of them can be read, see the migrate-models command.
+	ModelFormat string `json:"model_format"`
+	// How long to wait before checking a dead id again, by why it is dead ("missing", "deleted",
+	// "private", "empty" or "broken"). "never" leaves it dead for good. Reasons that aren't in
+	// here use DefaultRecheck.
+	Recheck map[string]string `json:"recheck"`
+}
+
+// Ids that never existed are most of the id space so they're never checked again. A private
+// track can be made public again, a broken one is usually a SoundCloud hiccup.
+var DefaultRecheck = map[string]string{
+	"missing": "never",
+	"deleted": "720h",
+	"private": "168h",
+	"empty":   "168h",
+	"broken":  "24h",
+}
+
+// A RecrawlTier decides how often an entity is crawled again in continuous mode.
+// Entities with more edges (comments, favorites or tracks in a playlist) change more often
+// so they can be put into a tier with a shorter interval.
+type RecrawlTier struct {
+	Name     string `json:"name"`
+	MinEdges int    `json:"min_edges"`
+	Interval string `json:"interval"` // Any string that time.ParseDuration understands ("24h", "168h"...)
+}
+
+var DefaultRecrawlTiers = []RecrawlTier{
+	{Name: "default", MinEdges: 0, Interval: "168h"},
+}
+
+func (t RecrawlTier) Duration() time.Duration {
+	d, err := time.ParseDuration(t.Interval)
+	if err != nil || d <= 0 {
+		// Fall back to crawling once a week
+		return 7 * 24 * time.Hour
+	}
+	return d
+}
+
+func (c Configuration) Poll() time.Duration {
+	d, err := time.ParseDuration(c.PollInterval)
+	if err != nil || d <= 0 {
+		return time.Minute
+	}
+	return d
+}
+
+func (c Configuration) Retry() time.Duration {
+	d, err := time.ParseDuration(c.RetryInterval)
+	if err != nil || d <= 0 {
+		return 6 * time.Hour
+	}
+	return d
+}
+
+func (c Configuration) Latency() time.Duration {
+	d, err := time.ParseDuration(c.MaxLatency)
+	if err != nil || d <= 0 {
+		return 2 * time.Second
+	}
+	return d
+}
+
+func (c Configuration) Adjust() time.Duration {
+	d, err := time.ParseDuration(c.AdjustInterval)
+	if err != nil || d <= 0 {
+		return 10 * time.Second
+	}
+	return d
+}
+
+func (c Configuration) ClaimAfter() time.Duration {
+	d, err := time.ParseDuration(c.ClaimAfterIdle)
+	if err != nil || d <= 0 {
+		return 30 * time.Minute
+	}
+	return d
+}
+
+// How long a single run is allowed to take. Zero means no limit.
+func (c Configuration) Duration() time.Duration {
+	d, err := time.ParseDuration(c.MaxDuration)
+	if err != nil || d <= 0 {
+		return 0
+	}
+	return d
+}
+
+func (c Configuration) RedisPort() int {
+	if c.Port <= 0 {
+		return 6379
+	}
+	return c.Port
+}
+
+func (c Configuration) Idle() time.Duration {
+	d, err := time.ParseDuration(c.IdleTimeout)
+	if err != nil || d <= 0 {
+		return time.Second
+	}
+	return d
+}
+
+func (c Configuration) Path() string {
+	if c.StoragePath == "" {
+		return "soundclouder.db"
+	}
+	return c.StoragePath
+}
+
+func (c Configuration) PipelineSize() int {
+	if c.Pipeline <= 0 {
+		return 100
+	}
+	return c.Pipeline
+}
+
+// How long after a dead id was checked it is checked again. false if it never is.
+func (c Configuration) RecheckAfter(reason string) (time.Duration, bool) {
+	after, ok := c.Recheck[reason]
+	if !ok {
+		after = DefaultRecheck[reason]
+	}
+	d, err := time.ParseDuration(after)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// Returns the tier with the highest MinEdges that the entity qualifies for. false if it doesn't
+// reach the MinEdges of any tier.
+func (c Configuration) Tier(edges int) (RecrawlTier, bool) {
+	tiers := c.RecrawlTiers
+	if len(tiers) == 0 {
+		tiers = DefaultRecrawlTiers
+	}
+	var tier RecrawlTier
+	found := false
+	for _, t := range tiers {
+		if edges >= t.MinEdges && (!found || t.MinEdges >= tier.MinEdges) {
+			tier, found = t, true
+		}
+	}
+	return tier, found
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Abramovic/soundclouder/crawler"
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"time"
+)
+
+// RunContinuous crawls tracks and playlists at the same time and never finishes on its own.
+// Batches are pushed onto the queues when they are due according to the schedule sorted sets and
+// new ids above the frontier are seeded as soon as we see them.
+func (c *Crawler) RunContinuous(r redis.Conn) {
+	track_ids := make(chan int, max_workers)
+	playlist_ids := make(chan int, max_workers)
+	var monitor sync.WaitGroup
+	monitor.Add(max_workers * 2)
+	for i := 0; i < max_workers; i++ {
+		go c.ProcessTracks(track_ids, &monitor)
+		go c.ProcessPlaylists(playlist_ids, &monitor)
+	}
+
+	poll := c.Config.Poll()
+	var lastPoll time.Time
+	for !stopped() {
+		now := time.Now()
+		if now.Sub(lastPoll) >= poll {
+			lastPoll = now
+			c.advanceFrontiers(r, now)
+		}
+		tracks, err := crawler.DueBatches(r, crawler.TrackSchedule, now, max_workers)
+		if err != nil {
+			fmt.Println(err)
+		}
+		playlists, err := crawler.DueBatches(r, crawler.PlaylistSchedule, now, max_workers)
+		if err != nil {
+			fmt.Println(err)
+		}
+		for _, i := range tracks {
+			c.TrackQueue.Push(r, i)
+		}
+		for _, i := range playlists {
+			c.PlaylistQueue.Push(r, i)
+		}
+		// The queues also hold anything left over from seeding or a restart
+		fed := c.feed(r, c.TrackQueue, track_ids, max_workers)
+		fed += c.feed(r, c.PlaylistQueue, playlist_ids, max_workers)
+		if fed == 0 {
+			// Nothing is due right now so wait a bit before checking again
+			select {
+			case <-time.After(poll):
+			case <-stopping:
+			}
+		}
+	}
+	close(track_ids)
+	close(playlist_ids)
+	monitor.Wait()
+}
+
+func (c *Crawler) advanceFrontiers(r redis.Conn, now time.Time) {
+	g := c.Graph()
+	defer g.Close()
+	max_id, err := c.GetHighTrackId()
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		crawler.AdvanceFrontier(r, g, crawler.TrackFrontier, store.Tracks, crawler.TrackSchedule, max_id, now)
+	}
+
+	// There is no way to ask SoundCloud for the newest playlist. If anything in the highest batch
+	// that we know about turned out to be a real playlist then there are probably more above it.
+	frontier, err := redis.Int(r.Do("GET", crawler.Key(crawler.PlaylistFrontier)))
+	if err != nil {
+		return
+	}
+	// Dead playlists have no next crawl, so any next crawl means a live one
+	first, last := crawler.BatchRange(crawler.BatchId(frontier))
+	_, live, err := g.EarliestNextCrawl(store.Playlists, first, last)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if live {
+		crawler.AdvanceFrontier(r, g, crawler.PlaylistFrontier, store.Playlists, crawler.PlaylistSchedule, frontier+crawler.BatchSize, now)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Abramovic/soundclouder/crawler"
+	"os"
+	"strings"
+)
+
+// Sends a control command to every worker sharing this Redis.
+//
+//	./soundclouder control pause
+//	./soundclouder control resume
+//	./soundclouder control drain
+//	./soundclouder control concurrency 50
+func (c *Crawler) control(args []string) {
+	if len(args) == 0 {
+		fmt.Println("usage: soundclouder control pause|resume|drain|concurrency <n>")
+		os.Exit(1)
+	}
+	cmd, err := crawler.ParseCommand(strings.Join(args, ":"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	r := c.RedisClient.Get()
+	defer r.Close()
+	n, err := crawler.SendControl(r, cmd)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Sent %s to %d workers\n", cmd, n)
+}
+
+// Called by every worker when a control command comes in.
+func (c *Crawler) handleControl(cmd crawler.Command) {
+	switch cmd.Action {
+	case crawler.ControlPause:
+		fmt.Println("Pausing. Current batches will finish and no new ones will start.")
+		c.Concurrency.Pause()
+	case crawler.ControlResume:
+		fmt.Println("Resuming.")
+		c.Concurrency.Resume()
+	case crawler.ControlDrain:
+		c.stop("Drain command recieved.")
+	case crawler.ControlConcurrency:
+		c.Concurrency.SetTarget(cmd.Value)
+		c.publishConcurrency(c.Concurrency.Target())
+	}
+}
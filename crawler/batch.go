@@ -0,0 +1,356 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+)
+
+// The batch size decides both how ids are grouped into Redis hashes and how many ids a worker
+// crawls at once. It is stored once in Redis so every worker sharing the crawl uses the same one.
+const BatchSizeKey = "batchSize"
+
+const DefaultBatchSize = 1000
+
+var BatchSize = DefaultBatchSize
+
+// Every hash that is bucketed by RedisKey. These are the ones that have to be re-bucketed when
+// the batch size changes.
+var BatchedHashes = []string{
+	"trackMeta",
+	"userMeta",
+	"trackCommenters",
+	"trackFavoriters",
+	"trackCountPlaylist",
+	"trackCountCommenters",
+	"trackCountFavoriters",
+	"playlistTracks",
+	"trackLastCrawl",
+	"trackNextCrawl",
+	"playlistLastCrawl",
+	"playlistNextCrawl",
+	"trackTombstones",
+	"playlistTombstones",
+	SamplePrefix + "trackMeta",
+	SamplePrefix + "playlistTracks",
+}
+
+// Sets and sorted sets whose members are batch ids
+var batchedSets = []string{"crawlTracks", "crawlTracksTodo", "crawlPlaylists", "crawlPlaylistsTodo"}
+var batchedSchedules = []string{TrackSchedule, PlaylistSchedule}
+
+func BatchId(id int) int {
+	return id / BatchSize
+}
+
+// The first and last id that belong to a batch
+func BatchRange(batch_id int) (int, int) {
+	return batch_id * BatchSize, batch_id*BatchSize + BatchSize - 1
+}
+
+// Uses the batch size stored in Redis. A new crawl stores the configured size (or the default).
+// If the configured size doesn't match what is stored, the stored one wins until the crawl is
+// migrated with the rebatch command.
+func LoadBatchSize(r redis.Conn, configured int) error {
+	if configured <= 0 {
+		configured = DefaultBatchSize
+	}
+	// The batch size is the first thing a new crawl stores, so that's when it gets its version.
+	// A crawl from before there was a batch size has data but no batchSize key. It was crawled
+	// with batches of 1000 and stays on version 1 until it is migrated.
+	exists, err := redis.Bool(r.Do("EXISTS", Key(BatchSizeKey)))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		legacy, err := hasCrawlData(r)
+		if err != nil {
+			return err
+		}
+		stored := configured
+		if legacy {
+			stored = DefaultBatchSize
+		}
+		created, _ := redis.String(r.Do("SET", Key(BatchSizeKey), stored, "NX"))
+		if created == "OK" && !legacy {
+			if err := initSchema(r); err != nil {
+				return err
+			}
+		}
+	}
+	size, err := redis.Int(r.Do("GET", Key(BatchSizeKey)))
+	if err != nil {
+		return err
+	}
+	if size <= 0 {
+		return fmt.Errorf("invalid batch size %d stored in %s", size, BatchSizeKey)
+	}
+	if size != configured {
+		fmt.Printf("This crawl uses a batch size of %d (configured %d). Run the rebatch command to change it.\n", size, configured)
+	}
+	BatchSize = size
+	return nil
+}
+
+var errFound = errors.New("found")
+
+// Whether the namespace has any tracks or playlists in it, pending ones included
+func hasCrawlData(r redis.Conn) (bool, error) {
+	for _, hash := range []string{"trackMeta", "playlistTracks"} {
+		err := scanKeys(r, Key(hash)+":*", func(string) error {
+			return errFound
+		})
+		if err == errFound {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+const rebatchProgress = "rebatch"
+
+var ErrQueueNotEmpty = errors.New("the stream queues still have batches in them, let them finish before changing the batch size")
+
+// Shards are picked by batch id, so the batches of a -from/-to/-shard run can't be moved over to
+// another size.
+var ErrSelectionQueues = errors.New("a -from/-to/-shard run still has batches queued, finish it (run it again with -empty=false) before changing the batch size")
+
+// True if any queue of a run limited to a selection (crawlTracks:<selection> and so on) still
+// has a batch in it. An empty set doesn't exist but an empty stream does.
+func selectionQueued(r redis.Conn) (bool, error) {
+	for _, queue := range append(append([]string{}, batchedSets...), "crawlTracksStream", "crawlPlaylistsStream") {
+		err := scanKeys(r, Key(queue)+":*", func(key string) error {
+			n := 1
+			if strings.HasSuffix(queue, "Stream") {
+				var err error
+				if n, err = redis.Int(r.Do("XLEN", key)); err != nil {
+					return err
+				}
+			}
+			if n > 0 {
+				return errFound
+			}
+			return nil
+		})
+		if err == errFound {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// Moves every batched hash and bitmap, queue and schedule over to a new batch size. New hashes are built
+// next to the old ones (prefix~size:batch) and only swapped in once they are complete, so running
+// it again after a crash picks up where it left off.
+func Rebatch(r redis.Conn, size int, progress func(string)) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid batch size %d", size)
+	}
+	for _, stream := range []string{"crawlTracksStream", "crawlPlaylistsStream"} {
+		n, _ := redis.Int(r.Do("XLEN", Key(stream)))
+		if n > 0 {
+			return ErrQueueNotEmpty
+		}
+	}
+	queued, err := selectionQueued(r)
+	if err != nil {
+		return err
+	}
+	if queued {
+		return ErrSelectionQueues
+	}
+	// Every bit is for a batch of the old size, and with the streams empty none of them are set
+	for _, stream := range []string{"crawlTracksStream", "crawlPlaylistsStream"} {
+		if _, err := r.Do("DEL", Key(stream+"Queued")); err != nil {
+			return err
+		}
+		if err := deleteKeys(r, Key(stream+"Queued")+":*"); err != nil {
+			return err
+		}
+	}
+	old := BatchSize
+	if size == old {
+		return nil
+	}
+	// Remember how far we got for each hash so a second run doesn't re-bucket keys that
+	// were already moved over to the new size.
+	target, err := redis.Int(r.Do("HGET", Key(rebatchProgress), "size"))
+	if err == nil && target != size {
+		return fmt.Errorf("a rebatch to %d was interrupted, finish it before changing to %d", target, size)
+	}
+	r.Do("HSET", Key(rebatchProgress), "size", size)
+
+	bitmaps := map[string]bool{}
+	for _, prefix := range BatchedBitmaps {
+		bitmaps[prefix] = true
+	}
+	for _, prefix := range append(append([]string{}, BatchedHashes...), BatchedBitmaps...) {
+		tmp := fmt.Sprintf("%s~%d", prefix, size)
+		phase, _ := redis.String(r.Do("HGET", Key(rebatchProgress), prefix))
+		if phase == "done" {
+			continue
+		}
+		if phase != "copied" {
+			copy := copyBuckets
+			if bitmaps[prefix] {
+				copy = copyBits
+			}
+			if err := copy(r, Key(prefix), Key(tmp), size); err != nil {
+				return err
+			}
+			r.Do("HSET", Key(rebatchProgress), prefix, "copied")
+		}
+		err = scanKeys(r, Key(tmp)+":*", func(key string) error {
+			_, err := r.Do("RENAME", key, Key(prefix)+strings.TrimPrefix(key, Key(tmp)))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		r.Do("HSET", Key(rebatchProgress), prefix, "done")
+		progress(prefix)
+	}
+
+	for _, set := range batchedSets {
+		if phase, _ := redis.String(r.Do("HGET", Key(rebatchProgress), set)); phase == "done" {
+			continue
+		}
+		batches, err := redis.Ints(r.Do("SMEMBERS", Key(set)))
+		if err != nil {
+			return err
+		}
+		args := []interface{}{Key(set)}
+		for _, b := range batches {
+			for _, nb := range rebucket(b, old, size) {
+				args = append(args, nb)
+			}
+		}
+		// Swap the set and mark it as done in one go so it never gets re-bucketed twice
+		r.Send("MULTI")
+		r.Send("DEL", Key(set))
+		if len(args) > 1 {
+			r.Send("SADD", args...)
+		}
+		r.Send("HSET", Key(rebatchProgress), set, "done")
+		if _, err := r.Do("EXEC"); err != nil {
+			return err
+		}
+		progress(set)
+	}
+
+	for _, schedule := range batchedSchedules {
+		if phase, _ := redis.String(r.Do("HGET", Key(rebatchProgress), schedule)); phase == "done" {
+			continue
+		}
+		due, err := redis.Int64Map(r.Do("ZRANGE", Key(schedule), 0, -1, "WITHSCORES"))
+		if err != nil {
+			return err
+		}
+		// A new batch is due as soon as any of the old batches it came from is due
+		scores := map[int]int64{}
+		for member, score := range due {
+			b, err := strconv.Atoi(member)
+			if err != nil {
+				continue
+			}
+			for _, nb := range rebucket(b, old, size) {
+				if s, ok := scores[nb]; !ok || score < s {
+					scores[nb] = score
+				}
+			}
+		}
+		r.Send("MULTI")
+		r.Send("DEL", Key(schedule))
+		for nb, score := range scores {
+			r.Send("ZADD", Key(schedule), score, nb)
+		}
+		r.Send("HSET", Key(rebatchProgress), schedule, "done")
+		if _, err := r.Do("EXEC"); err != nil {
+			return err
+		}
+		progress(schedule)
+	}
+
+	// The dead range map is only a hint so it is cheaper to learn it again than to re-bucket it
+	r.Do("DEL", Key("deadBatches:tracks"), Key("deadBatches:playlists"))
+
+	if _, err := r.Do("SET", Key(BatchSizeKey), size); err != nil {
+		return err
+	}
+	BatchSize = size
+	_, err = r.Do("DEL", Key(rebatchProgress))
+	return err
+}
+
+// Copies every prefix:<batch> hash into tmp:<batch> hashes bucketed by the new size and then
+// deletes the old hashes.
+func copyBuckets(r redis.Conn, prefix, tmp string, size int) error {
+	err := scanKeys(r, prefix+":*", func(key string) error {
+		fields, err := redis.StringMap(r.Do("HGETALL", key))
+		if err != nil {
+			return err
+		}
+		buckets := map[int][]interface{}{}
+		for field, value := range fields {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				continue
+			}
+			buckets[id/size] = append(buckets[id/size], field, value)
+		}
+		for batch_id, args := range buckets {
+			args = append([]interface{}{fmt.Sprintf("%s:%d", tmp, batch_id)}, args...)
+			if _, err := r.Do("HMSET", args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return scanKeys(r, prefix+":*", func(key string) error {
+		_, err := r.Do("DEL", key)
+		return err
+	})
+}
+
+// The batches under the new size that cover an old batch
+func rebucket(batch_id, old, size int) []int {
+	first := batch_id * old / size
+	last := (batch_id*old + old - 1) / size
+	batches := []int{}
+	for b := first; b <= last; b++ {
+		batches = append(batches, b)
+	}
+	return batches
+}
+
+// Walks every key matching pattern with SCAN so we never block Redis with KEYS.
+func scanKeys(r redis.Conn, pattern string, fn func(string) error) error {
+	cursor := "0"
+	for {
+		reply, err := redis.Values(r.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		cursor, _ = redis.String(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package crawler
+
+import (
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRebucket(t *testing.T) {
+	tests := []struct {
+		batch_id, old, size int
+		want                []int
+	}{
+		{0, 1000, 500, []int{0, 1}},
+		{3, 1000, 500, []int{6, 7}},
+		{3, 1000, 2000, []int{1}},
+		{1, 1000, 300, []int{3, 4, 5, 6}},
+		{2, 1000, 1000, []int{2}},
+	}
+	for _, test := range tests {
+		if got := rebucket(test.batch_id, test.old, test.size); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("rebucket(%d, %d, %d) = %v, want %v", test.batch_id, test.old, test.size, got, test.want)
+		}
+	}
+}
+
+func TestRebatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(r redis.Conn)
+		err   error
+	}{
+		{"idle", func(r redis.Conn) {}, nil},
+		{"stream", func(r redis.Conn) {
+			r.Do("XADD", Key("crawlTracksStream"), "*", "batch", 1)
+		}, ErrQueueNotEmpty},
+		{"selection", func(r redis.Conn) {
+			r.Do("SADD", Key("crawlTracks:from-1000"), 1)
+		}, ErrSelectionQueues},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, r := testRedis(t)
+			t.Cleanup(func() { BatchSize = DefaultBatchSize })
+			s := NewRedisStore(r, 0)
+			// One batch at a time, like the crawl adds them
+			s.AddPending(store.Tracks, []int{5})
+			s.AddPending(store.Tracks, []int{1500})
+			if err := s.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			r.Do("HSET", Key("trackMeta:0"), 5, "five")
+			r.Do("HSET", Key("trackMeta:1"), 1500, "fifteen hundred")
+			r.Do("SADD", Key("crawlTracks"), 0, 1)
+			r.Do("ZADD", Key(TrackSchedule), 100, 0, 50, 1)
+			test.setup(r)
+
+			err := Rebatch(r, 500, func(string) {})
+			if err != test.err {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+			if err != nil {
+				if BatchSize != DefaultBatchSize {
+					t.Errorf("batch size changed to %d even though the rebatch failed", BatchSize)
+				}
+				return
+			}
+
+			if BatchSize != 500 {
+				t.Errorf("batch size is %d, want 500", BatchSize)
+			}
+			if size, _ := redis.Int(r.Do("GET", Key(BatchSizeKey))); size != 500 {
+				t.Errorf("stored batch size is %d, want 500", size)
+			}
+			for key, id := range map[string]int{"trackMeta:0": 5, "trackMeta:3": 1500} {
+				if ok, _ := redis.Bool(r.Do("HEXISTS", Key(key), id)); !ok {
+					t.Errorf("%d isn't in %s", id, key)
+				}
+			}
+			if n, _ := redis.Int(r.Do("EXISTS", Key("trackMeta:1"))); n != 0 {
+				t.Errorf("the old trackMeta:1 is still there")
+			}
+			for _, id := range []int{5, 1500} {
+				key, bit := s.bit(store.Tracks, stateKnown, id)
+				if v, _ := redis.Int(r.Do("GETBIT", key, bit)); v != 1 {
+					t.Errorf("%d lost its known bit", id)
+				}
+			}
+			batches, _ := redis.Ints(r.Do("SMEMBERS", Key("crawlTracks")))
+			sort.Ints(batches)
+			if !reflect.DeepEqual(batches, []int{0, 1, 2, 3}) {
+				t.Errorf("queued %v, want 0 to 3", batches)
+			}
+			due, _ := redis.Int64Map(r.Do("ZRANGE", Key(TrackSchedule), 0, -1, "WITHSCORES"))
+			if !reflect.DeepEqual(due, map[string]int64{"0": 100, "1": 100, "2": 50, "3": 50}) {
+				t.Errorf("schedule is %v", due)
+			}
+			if n, _ := redis.Int(r.Do("EXISTS", Key(rebatchProgress))); n != 0 {
+				t.Errorf("the progress of the rebatch is left behind")
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package crawler
+
+import (
+	"github.com/Abramovic/soundclouder/models"
+	"github.com/Abramovic/soundclouder/store"
+	"sync"
+	"time"
+)
+
+// The benchmark writes into its own keys so it never touches a real crawl
+const BenchPrefix = "bench:"
+
+// BenchStore writes n made up tracks through RedisStore the same way a worker does (pending check,
+// track, user, 20 commenters and 20 favoriters with their counters, and crawl times) with workers
+// goroutines and pipeline writes per round trip. Returns how long it took.
+func (c *Crawler) BenchStore(n, workers, pipeline int) (time.Duration, error) {
+	ids := make(chan int, workers)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g := NewRedisStore(c.RedisClient.Get(), pipeline)
+			g.prefix = BenchPrefix
+			g.EdgeFormat = c.Config.EdgeFormat
+			g.ModelFormat = c.Config.ModelFormat
+			defer g.Close()
+			for id := range ids {
+				if err := benchTrack(g, id); err != nil {
+					errs <- err
+					return
+				}
+			}
+			if err := g.Flush(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	for id := 1; id <= n; id++ {
+		ids <- id
+	}
+	close(ids)
+	wg.Wait()
+	elapsed := time.Since(start)
+	select {
+	case err := <-errs:
+		return elapsed, err
+	default:
+		return elapsed, nil
+	}
+}
+
+func benchTrack(g store.GraphStore, id int) error {
+	if _, err := g.AddPending(store.Tracks, []int{id}); err != nil {
+		return err
+	}
+	if _, err := g.IsPending(store.Tracks, id); err != nil {
+		return err
+	}
+	if err := g.PutTrack(&models.Track{Id: id, Title: "benchmark"}); err != nil {
+		return err
+	}
+	if _, err := g.PutUser(models.UserPreview{Id: id % 1000}); err != nil {
+		return err
+	}
+	users := make([]int, 20)
+	for i := range users {
+		users[i] = id*20 + i
+	}
+	for _, edge := range []string{store.TrackCommenters, store.TrackFavoriters} {
+		if _, _, err := g.PutEdges(edge, id, users); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	return g.MarkCrawled(store.Tracks, id, now, now.Add(time.Hour))
+}
+
+// Deletes everything the benchmark wrote
+func (c *Crawler) ClearBench() error {
+	r := c.RedisClient.Get()
+	defer r.Close()
+	return scanKeys(r, Key(BenchPrefix)+"*", func(key string) error {
+		_, err := r.Do("DEL", key)
+		return err
+	})
+}
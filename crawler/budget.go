@@ -0,0 +1,62 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Returned instead of making an API request once the run has made MaxRequests of them
+var ErrOverBudget = errors.New("used up the budget of API requests")
+
+// A Budget limits how much a single run is allowed to crawl. Limits of zero are ignored. The batch
+// and time limits are checked before a worker starts on a new batch, so the batches already being
+// crawled are finished. Requests are charged one at a time, once they are used up the batches being
+// crawled stop too and stay on the queue for the next run like everything else.
+type Budget struct {
+	MaxRequests int64
+	MaxBatches  int64
+	Deadline    time.Time
+
+	mu       sync.Mutex
+	batches  int64
+	requests int64
+}
+
+func NewBudget(maxRequests, maxBatches int64, maxDuration time.Duration) *Budget {
+	b := &Budget{MaxRequests: maxRequests, MaxBatches: maxBatches}
+	if maxDuration > 0 {
+		b.Deadline = time.Now().Add(maxDuration)
+	}
+	return b
+}
+
+// Takes one batch out of the budget. Returns the reason we have to stop if the budget is used up.
+func (b *Budget) Take() (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.MaxRequests > 0 && b.requests >= b.MaxRequests {
+		return fmt.Sprintf("Made %d of %d API requests.", b.requests, b.MaxRequests), false
+	}
+	if b.MaxBatches > 0 && b.batches >= b.MaxBatches {
+		return fmt.Sprintf("Started %d of %d batches.", b.batches, b.MaxBatches), false
+	}
+	if !b.Deadline.IsZero() && time.Now().After(b.Deadline) {
+		return "Ran out of time.", false
+	}
+	b.batches++
+	return "", true
+}
+
+// Takes one API request out of the budget. Every request goes through here (see Crawler.get) so a
+// batch with a lot of comments and favoriters can't run far past the limit.
+func (b *Budget) Spend() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.MaxRequests > 0 && b.requests >= b.MaxRequests {
+		return false
+	}
+	b.requests++
+	return true
+}
@@ -0,0 +1,213 @@
+package crawler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every worker publishes its current concurrency target here so operators can see it
+const ConcurrencyTargets = "workerConcurrency"
+
+// Concurrency is a semaphore whose size changes while we crawl. Every API request reports how long it
+// took and how it ended. Every interval the target goes up a little while the p95 latency and error
+// rate stay healthy and gets cut in half as soon as SoundCloud throttles us (AIMD).
+type Concurrency struct {
+	Min          int
+	Max          int
+	Step         int
+	MaxLatency   time.Duration // p95 latency that we still consider healthy
+	MaxErrorRate float64
+	// SetTarget never goes above this. It's the max we started with since that's how many
+	// workers there are.
+	Ceiling int
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	target    int
+	active    int
+	paused    bool
+	stopped   bool
+	latencies []time.Duration
+	requests  int
+	errors    int
+	throttled int
+}
+
+func NewConcurrency(min, max, start, step int, maxLatency time.Duration, maxErrorRate float64) *Concurrency {
+	if max < 1 {
+		max = 1
+	}
+	if min < 1 || min > max {
+		min = 1
+	}
+	if start < min || start > max {
+		start = min
+	}
+	if step < 1 {
+		step = 1
+	}
+	a := &Concurrency{
+		Min:          min,
+		Max:          max,
+		Step:         step,
+		MaxLatency:   maxLatency,
+		MaxErrorRate: maxErrorRate,
+		Ceiling:      max,
+		target:       start,
+	}
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+// Blocks until there is room for one more batch under the current target and we aren't paused.
+// Returns false if we are stopping and the batch should not be crawled.
+func (a *Concurrency) Acquire() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for !a.stopped && (a.paused || a.active >= a.target) {
+		a.cond.Wait()
+	}
+	if a.stopped {
+		return false
+	}
+	a.active++
+	return true
+}
+
+func (a *Concurrency) Release() {
+	a.mu.Lock()
+	a.active--
+	a.mu.Unlock()
+	a.cond.Signal()
+}
+
+// Workers finish the batch they are on and then wait until Resume is called.
+func (a *Concurrency) Pause() {
+	a.mu.Lock()
+	a.paused = true
+	a.mu.Unlock()
+}
+
+func (a *Concurrency) Resume() {
+	a.mu.Lock()
+	a.paused = false
+	a.mu.Unlock()
+	a.cond.Broadcast()
+}
+
+func (a *Concurrency) Paused() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.paused
+}
+
+// Wakes up every worker that is waiting so they can exit.
+func (a *Concurrency) Stop() {
+	a.mu.Lock()
+	a.stopped = true
+	a.mu.Unlock()
+	a.cond.Broadcast()
+}
+
+func (a *Concurrency) Target() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.target
+}
+
+// Sets the target by hand, at most Ceiling. It also becomes the new max so the adaptive
+// concurrency won't climb back above it.
+func (a *Concurrency) SetTarget(target int) {
+	if target < 1 {
+		target = 1
+	}
+	a.mu.Lock()
+	if a.Ceiling > 0 && target > a.Ceiling {
+		target = a.Ceiling
+	}
+	a.Max = target
+	if a.Min > a.Max {
+		a.Min = a.Max
+	}
+	a.target = target
+	a.mu.Unlock()
+	a.cond.Broadcast()
+}
+
+func (a *Concurrency) clamp(target int) int {
+	if target < a.Min {
+		return a.Min
+	}
+	if target > a.Max {
+		return a.Max
+	}
+	return target
+}
+
+// Records the result of one API request. A status of 0 means the request never got a response.
+func (a *Concurrency) Observe(latency time.Duration, status int, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requests++
+	a.latencies = append(a.latencies, latency)
+	if status == 429 || status >= 500 {
+		a.throttled++
+	} else if err != nil || status >= 400 && status != 404 {
+		// A 404 is normal for us since most ids are deleted or private
+		a.errors++
+	}
+}
+
+// Looks at everything observed since the last call and moves the target. Returns the new target.
+func (a *Concurrency) Adjust() int {
+	a.mu.Lock()
+	latencies, requests, errors, throttled := a.latencies, a.requests, a.errors, a.throttled
+	a.latencies, a.requests, a.errors, a.throttled = nil, 0, 0, 0
+
+	switch {
+	case throttled > 0:
+		// Multiplicative decrease
+		a.target = a.clamp(a.target / 2)
+	case requests == 0:
+		// Nothing to go on
+	case p95(latencies) > a.MaxLatency || float64(errors)/float64(requests) > a.MaxErrorRate:
+		a.target = a.clamp(a.target - a.Step)
+	default:
+		// Additive increase
+		a.target = a.clamp(a.target + a.Step)
+	}
+	target := a.target
+	a.mu.Unlock()
+	a.cond.Broadcast()
+	return target
+}
+
+// Adjusts the target every interval until stop is closed. onChange is called whenever the target moves.
+func (a *Concurrency) Run(interval time.Duration, stop <-chan struct{}, onChange func(int)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := a.Target()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			target := a.Adjust()
+			if target != last && onChange != nil {
+				onChange(target)
+			}
+			last = target
+		}
+	}
+}
+
+func p95(latencies []time.Duration) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)*95)/100]
+}
@@ -0,0 +1,136 @@
+package crawler
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commands are published on the control channel so every worker hears them right away. The last
+// pause or resume and concurrency are also kept in the control hash so that a worker that starts
+// later picks them up. A drain is only for the workers that are running when it's sent.
+const (
+	ControlChannel = "crawlControl"
+	ControlState   = "crawlControlState"
+)
+
+const (
+	ControlPause       = "pause"
+	ControlResume      = "resume"
+	ControlDrain       = "drain"
+	ControlConcurrency = "concurrency"
+)
+
+type Command struct {
+	Action string
+	Value  int
+}
+
+func (cmd Command) String() string {
+	if cmd.Action == ControlConcurrency {
+		return fmt.Sprintf("%s:%d", cmd.Action, cmd.Value)
+	}
+	return cmd.Action
+}
+
+func ParseCommand(s string) (Command, error) {
+	parts := strings.SplitN(s, ":", 2)
+	cmd := Command{Action: parts[0]}
+	switch cmd.Action {
+	case ControlPause, ControlResume, ControlDrain:
+		return cmd, nil
+	case ControlConcurrency:
+		if len(parts) != 2 {
+			return cmd, fmt.Errorf("%s needs a value", ControlConcurrency)
+		}
+		v, err := strconv.Atoi(parts[1])
+		if err != nil || v < 1 {
+			return cmd, fmt.Errorf("invalid %s value %q", ControlConcurrency, parts[1])
+		}
+		cmd.Value = v
+		return cmd, nil
+	}
+	return cmd, fmt.Errorf("unknown control command %q", s)
+}
+
+// Sends a command to every worker that shares this Redis. Returns how many workers heard it.
+func SendControl(r redis.Conn, cmd Command) (int, error) {
+	switch cmd.Action {
+	case ControlConcurrency:
+		r.Do("HSET", Key(ControlState), ControlConcurrency, cmd.Value)
+	case ControlDrain:
+		// Everyone that hears it exits, so the next workers start from scratch
+		r.Do("HDEL", Key(ControlState), "state")
+	default:
+		r.Do("HSET", Key(ControlState), "state", cmd.Action)
+	}
+	return redis.Int(r.Do("PUBLISH", Key(ControlChannel), cmd.String()))
+}
+
+// Applies the last known state and then listens for new commands until stop is closed.
+func (c *Crawler) WatchControl(stop <-chan struct{}, handle func(Command)) {
+	r := c.RedisClient.Get()
+	state, err := redis.StringMap(r.Do("HGETALL", Key(ControlState)))
+	r.Close()
+	if err == nil {
+		if v, ok := state[ControlConcurrency]; ok {
+			if cmd, err := ParseCommand(ControlConcurrency + ":" + v); err == nil {
+				handle(cmd)
+			}
+		}
+		// A worker that joins late only needs to know if the cluster is paused. A "drain" left
+		// behind by an older version is ignored.
+		if state["state"] == ControlPause {
+			handle(Command{Action: ControlPause})
+		}
+	}
+
+	for {
+		psc := redis.PubSubConn{Conn: c.RedisClient.Get()}
+		if err := psc.Subscribe(Key(ControlChannel)); err != nil {
+			fmt.Println(err)
+			psc.Close()
+		} else {
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-stop:
+					psc.Unsubscribe()
+				case <-done:
+				}
+			}()
+			c.receiveControl(psc, handle)
+			close(done)
+			psc.Close()
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(5 * time.Second):
+			// Lost our connection to Redis so try to subscribe again
+		}
+	}
+}
+
+func (c *Crawler) receiveControl(psc redis.PubSubConn, handle func(Command)) {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			cmd, err := ParseCommand(string(v.Data))
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			handle(cmd)
+		case redis.Subscription:
+			if v.Count == 0 {
+				return
+			}
+		case error:
+			fmt.Println(v)
+			return
+		}
+	}
+}
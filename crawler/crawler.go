@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/Abramovic/soundclouder/config"
 	"github.com/Abramovic/soundclouder/models"
+	"github.com/Abramovic/soundclouder/store"
 	"github.com/carlescere/goback"
 	"github.com/garyburd/redigo/redis"
 	"io/ioutil"
@@ -18,20 +19,50 @@ type Crawler struct {
 	RedisClient *redis.Pool
 	HttpClient  *http.Client
 	BackOff     *goback.SimpleBackoff
+	Config      config.Configuration
+	Concurrency *Concurrency
+	Stats       *Stats
+	Budget      *Budget
+	// Batches of tracks and playlists waiting to be crawled
+	TrackQueue    Queue
+	PlaylistQueue Queue
+	// Batches that keep coming back empty
+	DeadTracks    *DeadRanges
+	DeadPlaylists *DeadRanges
+	// The bolt file of a crawl without Redis (see OpenStore)
+	Local *store.BoltStore
+	// Set when the graph goes to a local file (or a MemoryStore, see UseGraph) instead of Redis
+	graph store.SharedStore
 }
 
 var domain string = "http://api.soundcloud.com"
 
 func New(config config.Configuration) *Crawler {
-	return &Crawler{
+	SetNamespace(config.Namespace, config.Cluster)
+	c := &Crawler{
 		ClientId:    config.ClientId,
 		HttpClient:  CreateHTTPClient(),
-		RedisClient: CreateRedisClient(config.Host, 6379),
+		RedisClient: CreateRedisClient(config),
 		BackOff:     CreateGoback(),
+		Config:      config,
+		Concurrency: CreateConcurrency(config),
+		Stats:       NewStats(),
+		Budget:      NewBudget(config.MaxRequests, config.MaxBatches, config.Duration()),
 	}
+	if c.IsLocal() {
+		c.RedisClient = noRedisPool()
+	}
+	c.TrackQueue = c.NewQueue("tracks", Selector{})
+	c.PlaylistQueue = c.NewQueue("playlists", Selector{})
+	c.DeadTracks = c.NewDeadRanges("tracks")
+	c.DeadPlaylists = c.NewDeadRanges("playlists")
+	return c
 }
 
 func (c *Crawler) Close() error {
+	if c.graph != nil {
+		c.graph.CloseFile()
+	}
 	return c.RedisClient.Close()
 }
 
@@ -43,24 +74,20 @@ func CreateGoback() *goback.SimpleBackoff {
 	}
 }
 
-func CreateRedisClient(host string, port int) *redis.Pool {
-	// Creates a pointer to a pool of Redis connections
-	return &redis.Pool{
-		MaxIdle:     0,
-		MaxActive:   1000, // We might want to change this to improve performance.
-		IdleTimeout: 1 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
-			if err != nil {
-				return nil, err
-			}
-			return c, nil
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
+// Without adaptive concurrency the target is fixed at max_workers just like before.
+func CreateConcurrency(config config.Configuration) *Concurrency {
+	max := config.MaxWorkers
+	if max <= 0 {
+		max = 200
+	}
+	if !config.Adaptive {
+		return NewConcurrency(max, max, max, 1, config.Latency(), 1)
 	}
+	maxErrorRate := config.MaxErrorRate
+	if maxErrorRate <= 0 {
+		maxErrorRate = 0.05
+	}
+	return NewConcurrency(config.MinWorkers, max, config.StartWorkers, config.WorkerStep, config.Latency(), maxErrorRate)
 }
 
 func CreateHTTPClient() *http.Client {
@@ -76,9 +103,38 @@ func CreateHTTPClient() *http.Client {
 }
 
 // We will use Redis Hashes for a more memory efficent way of storing data.
+// Each hash holds one batch of ids (see BatchSize).
 func RedisKey(prefix string, id int) (string, string) {
-	i := (id / 1000)
-	return fmt.Sprintf("%s:%d", prefix, i), fmt.Sprintf("%d", id)
+	i := BatchId(id)
+	return fmt.Sprintf("%s:%d", Key(prefix), i), fmt.Sprintf("%d", id)
+}
+
+// Every request to the SoundCloud API goes through here so the adaptive concurrency can see how long
+// it took and whether we are getting throttled.
+func (c *Crawler) get(url string) (*http.Response, error) {
+	if c.Budget != nil && !c.Budget.Spend() {
+		return nil, ErrOverBudget
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := c.HttpClient.Do(req)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	if c.Concurrency != nil {
+		c.Concurrency.Observe(time.Since(start), status, err)
+	}
+	if c.Stats != nil {
+		c.Stats.Request()
+		if err != nil || status >= 400 && status != 404 {
+			c.Stats.Error()
+		}
+	}
+	return resp, err
 }
 
 func (c *Crawler) Wait() {
@@ -95,11 +151,7 @@ func (c *Crawler) Wait() {
 // Limit the results to just one track since we just need the highest track id
 func (c *Crawler) GetHighTrackId() (int, error) {
 	url := fmt.Sprintf("%s/tracks?client_id=%s&limit=1&created_at[from]=", domain, c.ClientId)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return 0, err
-	}
-	resp, err := c.HttpClient.Do(req)
+	resp, err := c.get(url)
 	if err != nil {
 		return 0, err
 	}
@@ -115,6 +167,9 @@ func (c *Crawler) GetHighTrackId() (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if len(t) == 0 {
+		return 0, fmt.Errorf("soundcloud didn't return any tracks (%d)", resp.StatusCode)
+	}
 	// Since we are getting back an array from SoundCloud we only want to return the first element
 	return t[0].Id, nil
 }
@@ -124,24 +179,24 @@ func (c *Crawler) GetPlaylist(id int) (*models.Playlist, error) {
 	var err error
 	var p models.Playlist
 	url := fmt.Sprintf("%s/playlists/%d?client_id=%s", domain, id, c.ClientId)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.HttpClient.Do(req)
-	if err != nil {
+	resp, err := c.get(url)
+	if err != nil && err != ErrOverBudget {
 		// We most likely hit some issue with SoundCloud... time to back off
 		c.Wait()
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := c.checkStatus(resp.StatusCode); err != nil {
+		return nil, err
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 	err = json.Unmarshal(body, &p)
-	if err != nil {
-		return nil, err
+	if err != nil || p.Id == 0 {
+		// A 200 that isn't a playlist
+		return nil, ErrBroken
 	}
 	return &p, nil
 }
@@ -150,59 +205,66 @@ func (c *Crawler) GetPlaylist(id int) (*models.Playlist, error) {
 func (c *Crawler) GetTrack(id int) (*models.Track, error) {
 	var t models.Track
 	url := fmt.Sprintf("%s/tracks/%d?client_id=%s", domain, id, c.ClientId)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.HttpClient.Do(req)
-	if err != nil {
+	resp, err := c.get(url)
+	if err != nil && err != ErrOverBudget {
 		// We most likely hit some issue with SoundCloud... time to back off
 		c.Wait()
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := c.checkStatus(resp.StatusCode); err != nil {
+		return nil, err
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 	err = json.Unmarshal(body, &t)
-	if err != nil {
-		return nil, err
+	if err != nil || t.Id == 0 {
+		// A 200 that isn't a track
+		return nil, ErrBroken
 	}
 	return &t, nil
 }
 
-func (c *Crawler) getTrackFavoriters(id, offset int) []models.Favoriter {
+// A page of favoriters or comments that we couldn't read is an error, an empty page is not. None of
+// the errors say anything about the track itself.
+func (c *Crawler) getTrackFavoriters(id, offset int) ([]models.Favoriter, error) {
 	var favoriters []models.Favoriter
 	url := fmt.Sprintf("%s/tracks/%d/favoriters?client_id=%s&limit=200&offset=%d", domain, id, c.ClientId, offset)
-	req, err := http.NewRequest("GET", url, nil)
+	resp, err := c.get(url)
 	if err != nil {
-		return favoriters
-	}
-	resp, err := c.HttpClient.Do(req)
-	if err != nil {
-		// We most likely hit some issue with SoundCloud... time to back off
-		c.Wait()
-		return favoriters
+		if err != ErrOverBudget {
+			// We most likely hit some issue with SoundCloud... time to back off
+			c.Wait()
+		}
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := c.checkStatus(resp.StatusCode); err != nil {
+		return nil, err
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return favoriters
+		return nil, err
 	}
 	err = json.Unmarshal(body, &favoriters)
 	if err != nil {
-		return favoriters
+		return nil, err
 	}
-	return favoriters
+	return favoriters, nil
 }
 
 // Get all of the favoriters from a Track. We can get up to 200 results at a time and use an offset to grab all of the favoriters
-func (c *Crawler) GetTrackFavoriters(id int) []models.Favoriter {
+// If any page fails we don't return a partial list, it would look like favoriters were removed.
+func (c *Crawler) GetTrackFavoriters(id int) ([]models.Favoriter, error) {
 	var offset int = 0
 	var favoriters []models.Favoriter
 	for {
-		results := c.getTrackFavoriters(id, offset)
+		results, err := c.getTrackFavoriters(id, offset)
+		if err != nil {
+			return nil, err
+		}
 		for _, result := range results {
 			favoriters = append(favoriters, result)
 		}
@@ -213,39 +275,43 @@ func (c *Crawler) GetTrackFavoriters(id int) []models.Favoriter {
 		}
 		offset += 200
 	}
-	return favoriters
+	return favoriters, nil
 }
 
-func (c *Crawler) getTrackComments(id, offset int) []models.Comment {
+func (c *Crawler) getTrackComments(id, offset int) ([]models.Comment, error) {
 	var comments []models.Comment
 	url := fmt.Sprintf("%s/tracks/%d/comments?client_id=%s&limit=200&offset=%d", domain, id, c.ClientId, offset)
-	req, err := http.NewRequest("GET", url, nil)
+	resp, err := c.get(url)
 	if err != nil {
-		return comments
-	}
-	resp, err := c.HttpClient.Do(req)
-	if err != nil {
-		// We most likely hit some issue with SoundCloud... time to back off
-		c.Wait()
-		return comments
+		if err != ErrOverBudget {
+			// We most likely hit some issue with SoundCloud... time to back off
+			c.Wait()
+		}
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := c.checkStatus(resp.StatusCode); err != nil {
+		return nil, err
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return comments
+		return nil, err
 	}
 	err = json.Unmarshal(body, &comments)
 	if err != nil {
-		return comments
+		return nil, err
 	}
-	return comments
+	return comments, nil
 }
 
-func (c *Crawler) GetTrackComments(id int) []models.Comment {
+func (c *Crawler) GetTrackComments(id int) ([]models.Comment, error) {
 	var offset int = 0
 	var comments []models.Comment
 	for {
-		results := c.getTrackComments(id, offset)
+		results, err := c.getTrackComments(id, offset)
+		if err != nil {
+			return nil, err
+		}
 		for _, result := range results {
 			comments = append(comments, result)
 		}
@@ -257,5 +323,5 @@ func (c *Crawler) GetTrackComments(id int) []models.Comment {
 		// Increment the offset by 200 even if we don't get back 200 results.
 		offset += 200
 	}
-	return comments
+	return comments, nil
 }
@@ -0,0 +1,160 @@
+package crawler
+
+import (
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+)
+
+// The crawl state of an id is kept in three bitmaps per batch, one bit per id at id % BatchSize:
+// <prefix>Known:<batch> for every id that was seeded, <prefix>Live:<batch> for the ones we have
+// data for and <prefix>Dead:<batch> for the ones with a tombstone. An id that is known but neither
+// live nor dead is pending. That's 3 bits per id instead of a "null" in a hash, so seeding a few
+// hundred million ids costs about a hundred MB instead of gigabytes.
+const (
+	stateKnown = "Known"
+	stateLive  = "Live"
+	stateDead  = "Dead"
+)
+
+var BatchedBitmaps = []string{
+	"trackKnown",
+	"trackLive",
+	"trackDead",
+	"playlistKnown",
+	"playlistLive",
+	"playlistDead",
+}
+
+// The key and bit of an id in one of the state bitmaps
+func (s *RedisStore) bit(kind, state string, id int) (string, int) {
+	key, _ := s.key(crawlPrefixes[kind]+state, id)
+	return key, id % BatchSize
+}
+
+// The id is stored, so it's known and live and not dead anymore
+func (s *RedisStore) markLive(kind string, id int) error {
+	for _, b := range []struct {
+		state string
+		value int
+	}{{stateKnown, 1}, {stateLive, 1}, {stateDead, 0}} {
+		key, offset := s.bit(kind, b.state, id)
+		if err := s.send("SETBIT", key, offset, b.value); err != nil {
+			return err
+		}
+	}
+	s.setKnown(kind, id)
+	key, hkey := s.key(crawlPrefixes[kind]+"Tombstones", id)
+	return s.send("HDEL", key, hkey)
+}
+
+// Keeps the known bitmap IsPending read in step with the known bits we set ourselves
+func (s *RedisStore) setKnown(kind string, id int) {
+	key, offset := s.bit(kind, stateKnown, id)
+	if key != s.knownKey {
+		return
+	}
+	for len(s.knownBits) <= offset/8 {
+		s.knownBits = append(s.knownBits, 0)
+	}
+	s.knownBits[offset/8] |= 0x80 >> uint(offset%8)
+}
+
+// The offsets of every bit that is set. Redis counts bits from the most significant bit of the
+// first byte.
+func setBits(b []byte) []int {
+	offsets := []int{}
+	for i, c := range b {
+		for j := 0; j < 8; j++ {
+			if c&(0x80>>uint(j)) != 0 {
+				offsets = append(offsets, i*8+j)
+			}
+		}
+	}
+	return offsets
+}
+
+// Copies every prefix:<batch> bitmap into tmp:<batch> bitmaps bucketed by the new size and then
+// deletes the old bitmaps. The bitmaps of the old and the new size are both offsets from the start
+// of their batch, so every set bit is moved over on its own.
+func copyBits(r redis.Conn, prefix, tmp string, size int) error {
+	err := scanKeys(r, prefix+":*", func(key string) error {
+		batch_id, err := strconv.Atoi(key[strings.LastIndex(key, ":")+1:])
+		if err != nil {
+			return nil
+		}
+		bits, err := redis.Bytes(r.Do("GET", key))
+		if err == redis.ErrNil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, offset := range setBits(bits) {
+			id := batch_id*BatchSize + offset
+			r.Send("SETBIT", tmp+":"+strconv.Itoa(id/size), id%size, 1)
+		}
+		return flushSent(r)
+	})
+	if err != nil {
+		return err
+	}
+	return scanKeys(r, prefix+":*", func(key string) error {
+		_, err := r.Do("DEL", key)
+		return err
+	})
+}
+
+// Moves a hash of the old layout over to the bitmaps: every field is known, "null" fields were
+// pending and are dropped, the rest are live unless they have a tombstone. Tombstones of ids that
+// were missing the only time we checked them don't say anything the dead bit doesn't, so they go
+// too.
+func stateBitmaps(r redis.Conn, key string) error {
+	i := strings.LastIndex(key, ":")
+	batch_id, err := strconv.Atoi(key[i+1:])
+	if err != nil {
+		return nil
+	}
+	kind := store.Tracks
+	if strings.TrimPrefix(key[:i], KeyPrefix) == stateHashes[store.Playlists] {
+		kind = store.Playlists
+	}
+	prefix := crawlPrefixes[kind]
+	batch := ":" + strconv.Itoa(batch_id)
+	fields, err := redis.StringMap(r.Do("HGETALL", key))
+	if err != nil {
+		return err
+	}
+	tombstones, err := redis.StringMap(r.Do("HGETALL", Key(prefix+"Tombstones")+batch))
+	if err != nil {
+		return err
+	}
+	for field, v := range fields {
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		offset := id % BatchSize
+		r.Send("SETBIT", Key(prefix+stateKnown)+batch, offset, 1)
+		if _, dead := tombstones[field]; dead {
+			r.Send("SETBIT", Key(prefix+stateDead)+batch, offset, 1)
+		} else if v != "null" {
+			r.Send("SETBIT", Key(prefix+stateLive)+batch, offset, 1)
+		}
+	}
+	// Nothing is deleted unless every bit is set, so a step that failed and is run again still
+	// finds every id
+	if err := flushSent(r); err != nil {
+		return err
+	}
+	for field, v := range fields {
+		if v == "null" {
+			r.Send("HDEL", key, field)
+		}
+		if t, err := store.ParseTombstone(tombstones[field]); err == nil && t.Reason == store.DeadMissing && t.Checks == 1 {
+			r.Send("HDEL", Key(prefix+"Tombstones")+batch, field)
+		}
+	}
+	return flushSent(r)
+}
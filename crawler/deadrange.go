@@ -0,0 +1,78 @@
+package crawler
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// Large stretches of the id space have no public tracks or playlists at all. For every batch we
+// remember how many passes in a row came back without a single hit. Once a batch (or both of its
+// neighbours, which makes it part of a dead region) reaches DeadAfter we only probe every
+// ProbeEvery-th id. If one of the probes hits, the rest of the batch is crawled as usual.
+type DeadRanges struct {
+	Key        string
+	DeadAfter  int
+	ProbeEvery int
+}
+
+func (c *Crawler) NewDeadRanges(kind string) *DeadRanges {
+	d := &DeadRanges{
+		Key:        Key("deadBatches:" + kind),
+		DeadAfter:  c.Config.DeadAfter,
+		ProbeEvery: c.Config.ProbeEvery,
+	}
+	if d.DeadAfter <= 0 {
+		d.DeadAfter = 2
+	}
+	if d.ProbeEvery <= 0 {
+		d.ProbeEvery = 50
+	}
+	return d
+}
+
+// Returns true if the batch should only be probed and how many empty passes it has had.
+func (d *DeadRanges) Probing(r redis.Conn, batch_id int) (bool, int) {
+	passes, err := redis.Ints(r.Do("HMGET", d.Key, batch_id, batch_id-1, batch_id+1))
+	if err != nil || len(passes) != 3 {
+		return false, 0
+	}
+	if passes[0] >= d.DeadAfter {
+		return true, passes[0]
+	}
+	// A batch we know nothing about yet in the middle of a dead region is most likely dead too
+	if passes[1] >= d.DeadAfter && passes[2] >= d.DeadAfter {
+		return true, passes[0]
+	}
+	return false, passes[0]
+}
+
+// Which ids get probed moves along with every pass so we eventually cover the whole batch.
+func (d *DeadRanges) IsProbe(id, pass int) bool {
+	return (id+pass)%d.ProbeEvery == 0
+}
+
+// Moves the probes to the front so we know whether the batch is alive before reaching the rest.
+func (d *DeadRanges) ProbesFirst(ids []int, pass int) []int {
+	probes := []int{}
+	rest := []int{}
+	for _, id := range ids {
+		if d.IsProbe(id, pass) {
+			probes = append(probes, id)
+		} else {
+			rest = append(rest, id)
+		}
+	}
+	return append(probes, rest...)
+}
+
+// Records how a pass over the batch went. checked is how many ids we asked SoundCloud for plus
+// the dead ones we didn't ask about again, hits how many of them are live.
+func (d *DeadRanges) Record(r redis.Conn, batch_id, checked, hits int) {
+	if checked == 0 {
+		return
+	}
+	if hits > 0 {
+		r.Do("HDEL", d.Key, batch_id)
+		return
+	}
+	r.Do("HINCRBY", d.Key, batch_id, 1)
+}
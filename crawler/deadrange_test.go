@@ -0,0 +1,68 @@
+package crawler
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"testing"
+)
+
+func TestDeadRanges(t *testing.T) {
+	_, r := testRedis(t)
+	d := (&Crawler{}).NewDeadRanges("tracks")
+	if d.DeadAfter != 2 || d.ProbeEvery != 50 {
+		t.Fatalf("defaults are %d and %d, want 2 and 50", d.DeadAfter, d.ProbeEvery)
+	}
+	// Batch 10 is dead, 20 and 22 are dead around 21, 30 had a hit after two empty passes
+	passes := []struct {
+		batch_id, checked, hits int
+	}{
+		{10, 5, 0}, {10, 5, 0},
+		{20, 5, 0}, {20, 5, 0}, {22, 5, 0}, {22, 5, 0},
+		{30, 5, 0}, {30, 5, 0}, {30, 5, 1},
+		// Nothing asked, says nothing
+		{40, 0, 0}, {40, 0, 0},
+	}
+	for _, p := range passes {
+		d.Record(r, p.batch_id, p.checked, p.hits)
+	}
+
+	tests := []struct {
+		batch_id int
+		probing  bool
+		empty    int
+	}{
+		{10, true, 2},
+		{11, false, 0},
+		{21, true, 0},
+		{30, false, 0},
+		{40, false, 0},
+		{50, false, 0},
+	}
+	for _, test := range tests {
+		probing, empty := d.Probing(r, test.batch_id)
+		if probing != test.probing || empty != test.empty {
+			t.Errorf("Probing(%d) = %v, %d, want %v, %d", test.batch_id, probing, empty, test.probing, test.empty)
+		}
+	}
+	if n, _ := redis.Int(r.Do("HLEN", d.Key)); n != 3 {
+		t.Errorf("%d batches are tracked, want 3", n)
+	}
+}
+
+func TestProbesFirst(t *testing.T) {
+	d := &DeadRanges{ProbeEvery: 4}
+	ids := []int{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	tests := []struct {
+		pass int
+		want []int
+	}{
+		{0, []int{4, 8, 1, 2, 3, 5, 6, 7, 9}},
+		{1, []int{3, 7, 1, 2, 4, 5, 6, 8, 9}},
+		{3, []int{1, 5, 9, 2, 3, 4, 6, 7, 8}},
+	}
+	for _, test := range tests {
+		if got := d.ProbesFirst(ids, test.pass); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("pass %d: got %v, want %v", test.pass, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,780 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/vmihailenco/msgpack"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A namespace archive starts with dumpMagic followed by chunks. Every chunk is a kind byte, the
+// length and the CRC32 of its payload (both uint32, big endian) and the payload, a deflated
+// MessagePack value. The header chunk says which namespace was dumped, every keys chunk holds one
+// SCAN page and the end chunk has the SHA-256 of everything before it. Keys are stored without
+// the namespace and as plain values instead of DUMP, so an archive can be restored under any name
+// into any Redis.
+const dumpMagic = "soundclouder-dump 1\n"
+
+const (
+	chunkHeader byte = 'H'
+	chunkKeys   byte = 'K'
+	chunkEnd    byte = 'E'
+)
+
+// Where a restore got to in the target namespace: the SHA-256 of the archive and how many keys
+// chunks are in
+const restoreProgress = "restoreProgress"
+
+// About how many bytes of keys go into one chunk before it is written out. A single string can
+// still be bigger, it can't be split.
+var maxChunk = 16 << 20
+
+var (
+	ErrBadArchive   = errors.New("not a namespace archive or it is corrupt")
+	ErrDumpComplete = errors.New("the archive is already complete")
+)
+
+type dumpHeader struct {
+	Namespace string
+	Created   int64
+}
+
+// One key. Values depends on the type: the value of a string, field and value pairs of a hash,
+// member and score pairs of a sorted set, the members of a set or the items of a list.
+type DumpKey struct {
+	Key     string
+	Type    string
+	TTL     int64 // milliseconds, 0 if the key doesn't expire
+	Values  []string
+	Entries []DumpEntry // only streams
+	// A key too big for one chunk is split up. Every part after the first one is added to what
+	// the parts before it restored.
+	Append bool
+	// Where the items of a part of a list start in the whole list
+	Offset int
+}
+
+type DumpEntry struct {
+	Id     string
+	Fields []string
+}
+
+// Cursor is where SCAN goes on after this page, so a dump that was interrupted carries on from
+// the last chunk that made it into the file. A page too big for one chunk is written in parts and
+// every part but the last one is Partial.
+type dumpPage struct {
+	Cursor  string
+	Keys    []DumpKey
+	Partial bool
+}
+
+// How many keys are in the page, parts of a split key only count once
+func (p dumpPage) count() int {
+	n := 0
+	for _, k := range p.Keys {
+		if !k.Append {
+			n++
+		}
+	}
+	return n
+}
+
+type dumpEnd struct {
+	Keys   int
+	Chunks int
+	SHA256 string
+}
+
+func writeChunk(w io.Writer, kind byte, v interface{}) error {
+	var payload bytes.Buffer
+	fw, err := flate.NewWriter(&payload, flate.BestSpeed)
+	if err != nil {
+		return err
+	}
+	if err := msgpack.NewEncoder(fw).Encode(v); err != nil {
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	head := make([]byte, 9)
+	head[0] = kind
+	binary.BigEndian.PutUint32(head[1:5], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(head[5:9], crc32.ChecksumIEEE(payload.Bytes()))
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err = w.Write(payload.Bytes())
+	return err
+}
+
+// Reads the archive one chunk at a time and keeps the SHA-256 of everything up to the end chunk
+type archiveReader struct {
+	r      *bufio.Reader
+	sum    hash.Hash
+	offset int64
+}
+
+func newArchiveReader(r io.Reader) (*archiveReader, error) {
+	a := &archiveReader{r: bufio.NewReader(r), sum: sha256.New()}
+	magic := make([]byte, len(dumpMagic))
+	if _, err := io.ReadFull(a.r, magic); err != nil || string(magic) != dumpMagic {
+		return nil, ErrBadArchive
+	}
+	a.sum.Write(magic)
+	a.offset = int64(len(magic))
+	return a, nil
+}
+
+// Returns the kind of the next chunk and its payload inflated. io.EOF means a clean end of the
+// file and ErrBadArchive a chunk that is cut off or doesn't match its CRC32.
+func (a *archiveReader) next() (byte, []byte, error) {
+	head := make([]byte, 9)
+	if _, err := io.ReadFull(a.r, head); err == io.EOF {
+		return 0, nil, io.EOF
+	} else if err != nil {
+		return 0, nil, ErrBadArchive
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(head[1:5]))
+	if _, err := io.ReadFull(a.r, payload); err != nil {
+		return 0, nil, ErrBadArchive
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(head[5:9]) {
+		return 0, nil, ErrBadArchive
+	}
+	body, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+	if err != nil {
+		return 0, nil, ErrBadArchive
+	}
+	if head[0] != chunkEnd {
+		a.sum.Write(head)
+		a.sum.Write(payload)
+	}
+	a.offset += int64(len(head) + len(payload))
+	return head[0], body, nil
+}
+
+// Reads a chunk that has to be of kind into v
+func (a *archiveReader) read(kind byte, v interface{}) error {
+	k, body, err := a.next()
+	if err != nil {
+		return err
+	}
+	if k != kind || msgpack.Unmarshal(body, v) != nil {
+		return ErrBadArchive
+	}
+	return nil
+}
+
+func (a *archiveReader) checksum() string {
+	return fmt.Sprintf("%x", a.sum.Sum(nil))
+}
+
+// Writes every key of a namespace to path. It walks the keys with SCAN and reads big keys a page
+// at a time (HSCAN, SSCAN, ZSCAN, LRANGE, XRANGE) so Redis is never blocked for long. Every SCAN
+// page goes into the file as a chunk and is synced, so if the dump is interrupted running it again
+// with the same file drops whatever chunk was cut off and carries on from there. Keys that change
+// while the dump runs are saved as they are when they're read, pause or drain the workers for a
+// consistent archive. name can be "" for the crawl without a namespace. Returns how many keys were
+// written.
+func DumpNamespace(r redis.Conn, name, path string, progress func(int)) (int, error) {
+	source, err := sourceKeys(r, name)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	cursor, keys, chunks := "0", 0, 0
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	started, err := startedDump(f, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	if !started {
+		if err := startDump(f, name); err != nil {
+			return 0, err
+		}
+	} else {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		a, err := newArchiveReader(f)
+		if err != nil {
+			return 0, err
+		}
+		var header dumpHeader
+		if err := a.read(chunkHeader, &header); err != nil {
+			return 0, ErrBadArchive
+		}
+		if header.Namespace != name {
+			return 0, fmt.Errorf("%s is a dump of %q, not %q", path, header.Namespace, name)
+		}
+		// Where the last whole page ends. The parts of a page that didn't get all of its chunks in
+		// are dropped with whatever was cut off, the page is done again from its start.
+		end, pageKeys, pageChunks := a.offset, 0, 0
+		for {
+			var page dumpPage
+			kind, body, err := a.next()
+			if err == nil && kind == chunkKeys && msgpack.Unmarshal(body, &page) != nil {
+				err = ErrBadArchive
+			}
+			if err == io.EOF || err == ErrBadArchive {
+				if err := f.Truncate(end); err != nil {
+					return 0, err
+				}
+				if _, err := f.Seek(end, io.SeekStart); err != nil {
+					return 0, err
+				}
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+			if kind == chunkEnd {
+				return 0, ErrDumpComplete
+			}
+			pageKeys += page.count()
+			pageChunks++
+			if page.Partial {
+				continue
+			}
+			cursor = page.Cursor
+			keys += pageKeys
+			chunks += pageChunks
+			end, pageKeys, pageChunks = a.offset, 0, 0
+		}
+		if chunks > 0 && cursor == "0" {
+			// Every page made it, only the end chunk is missing
+			return keys, finishDump(f, keys, chunks)
+		}
+	}
+
+	for {
+		reply, err := redis.Values(r.Do("SCAN", cursor, "MATCH", source.pattern(), "COUNT", 1000))
+		if err != nil {
+			return keys, err
+		}
+		previous := cursor
+		cursor, _ = redis.String(reply[0], nil)
+		names, _ := redis.Strings(reply[1], nil)
+		// A page that is too big for one chunk is written in parts. Only the last part has the
+		// cursor after the page, a dump that is resumed after one of the others does the whole
+		// page again.
+		page := dumpPage{Cursor: previous, Partial: true}
+		size := 0
+		write := func() error {
+			if err := writeChunk(f, chunkKeys, page); err != nil {
+				return err
+			}
+			if err := f.Sync(); err != nil {
+				return err
+			}
+			n := page.count()
+			if keys/10000 != (keys+n)/10000 {
+				progress(keys + n)
+			}
+			keys += n
+			chunks++
+			page.Keys, size = nil, 0
+			return nil
+		}
+		for _, key := range names {
+			if !source.has(key) {
+				continue
+			}
+			k, ok, err := readKey(r, key)
+			if err != nil {
+				return keys, fmt.Errorf("%s: %v", key, err)
+			}
+			if !ok {
+				continue
+			}
+			k.Key = strings.TrimPrefix(key, source.prefix)
+			for _, part := range splitKey(k) {
+				if size > 0 && size+keySize(part) > maxChunk {
+					if err := write(); err != nil {
+						return keys, err
+					}
+				}
+				page.Keys = append(page.Keys, part)
+				size += keySize(part)
+			}
+		}
+		page.Cursor, page.Partial = cursor, false
+		// A page without keys only moves the cursor, a resumed dump can just do it again
+		if len(page.Keys) > 0 {
+			if err := write(); err != nil {
+				return keys, err
+			}
+		}
+		if cursor == "0" {
+			return keys, finishDump(f, keys, chunks)
+		}
+	}
+}
+
+// Whether the file already has the start of a dump in it. A file that was cut off before its
+// header made it only has (part of) dumpMagic in it and is started again. Anything else that isn't
+// an archive is left alone.
+func startedDump(f *os.File, size int64) (bool, error) {
+	if size == 0 {
+		return false, nil
+	}
+	a, err := newArchiveReader(f)
+	if err == nil {
+		if _, _, err := a.next(); err == nil {
+			return true, nil
+		}
+		// The header is tiny, a bigger file with a broken one is something else
+		if size > int64(len(dumpMagic))+1024 {
+			return false, ErrBadArchive
+		}
+		return false, nil
+	}
+	if size > int64(len(dumpMagic)) {
+		return false, ErrBadArchive
+	}
+	head := make([]byte, size)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return false, err
+	}
+	if !strings.HasPrefix(dumpMagic, string(head)) {
+		return false, ErrBadArchive
+	}
+	return false, nil
+}
+
+// Writes the magic and the header in one go
+func startDump(f *os.File, name string) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	b.WriteString(dumpMagic)
+	if err := writeChunk(&b, chunkHeader, dumpHeader{Namespace: name, Created: time.Now().Unix()}); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(b.Bytes(), 0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(int64(b.Len()), io.SeekStart); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Roughly how many bytes a key takes in a chunk
+func keySize(k DumpKey) int {
+	n := len(k.Key) + len(k.Type) + 16
+	for _, v := range k.Values {
+		n += len(v) + 2
+	}
+	for _, e := range k.Entries {
+		n += len(e.Id) + 2
+		for _, f := range e.Fields {
+			n += len(f) + 2
+		}
+	}
+	return n
+}
+
+// Splits a key that is bigger than maxChunk. Hashes and sorted sets are only split between
+// pairs. Strings are never split.
+func splitKey(k DumpKey) []DumpKey {
+	if keySize(k) <= maxChunk || k.Type == "string" {
+		return []DumpKey{k}
+	}
+	parts := []DumpKey{}
+	part := DumpKey{Key: k.Key, Type: k.Type, TTL: k.TTL}
+	step := 1
+	if k.Type == "hash" || k.Type == "zset" {
+		step = 2
+	}
+	offset := 0
+	add := func() {
+		parts = append(parts, part)
+		offset += len(part.Values)
+		part = DumpKey{Key: k.Key, Type: k.Type, TTL: k.TTL, Append: true, Offset: offset}
+	}
+	for i := 0; i < len(k.Values); i += step {
+		j := i + step
+		if j > len(k.Values) {
+			j = len(k.Values)
+		}
+		v := k.Values[i:j]
+		if len(part.Values) > 0 && keySize(part)+keySize(DumpKey{Values: v}) > maxChunk {
+			add()
+		}
+		part.Values = append(part.Values, v...)
+	}
+	for _, e := range k.Entries {
+		if len(part.Entries) > 0 && keySize(part)+keySize(DumpKey{Entries: []DumpEntry{e}}) > maxChunk {
+			add()
+		}
+		part.Entries = append(part.Entries, e)
+	}
+	return append(parts, part)
+}
+
+// Checksums everything that was written and adds the end chunk
+func finishDump(f *os.File, keys, chunks int) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	a, err := newArchiveReader(f)
+	if err != nil {
+		return err
+	}
+	for {
+		if _, _, err := a.next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if _, err := f.Seek(a.offset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeChunk(f, chunkEnd, dumpEnd{Keys: keys, Chunks: chunks, SHA256: a.checksum()}); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Reads a key in pages. false if it's gone since SCAN returned it.
+func readKey(r redis.Conn, key string) (DumpKey, bool, error) {
+	k := DumpKey{}
+	var err error
+	k.Type, err = redis.String(r.Do("TYPE", key))
+	if err != nil || k.Type == "none" {
+		return k, false, err
+	}
+	ttl, err := redis.Int64(r.Do("PTTL", key))
+	if err != nil {
+		return k, false, err
+	}
+	if ttl > 0 {
+		k.TTL = ttl
+	}
+	switch k.Type {
+	case "string":
+		v, err := redis.String(r.Do("GET", key))
+		if err == redis.ErrNil {
+			return k, false, nil
+		}
+		k.Values = []string{v}
+		return k, err == nil, err
+	case "hash":
+		k.Values, err = scanMembers(r, "HSCAN", key)
+	case "set":
+		k.Values, err = scanMembers(r, "SSCAN", key)
+	case "zset":
+		k.Values, err = scanMembers(r, "ZSCAN", key)
+	case "list":
+		for start := 0; ; start += 1000 {
+			items, err := redis.Strings(r.Do("LRANGE", key, start, start+999))
+			if err != nil {
+				return k, false, err
+			}
+			k.Values = append(k.Values, items...)
+			if len(items) < 1000 {
+				break
+			}
+		}
+	case "stream":
+		start := "-"
+		for {
+			entries, err := redis.Values(r.Do("XRANGE", key, start, "+", "COUNT", 1000))
+			if err != nil {
+				return k, false, err
+			}
+			for _, e := range entries {
+				entry, err := redis.Values(e, nil)
+				if err != nil || len(entry) != 2 {
+					return k, false, fmt.Errorf("unexpected XRANGE reply")
+				}
+				id, _ := redis.String(entry[0], nil)
+				fields, _ := redis.Strings(entry[1], nil)
+				k.Entries = append(k.Entries, DumpEntry{Id: id, Fields: fields})
+				start = "(" + id
+			}
+			if len(entries) < 1000 {
+				break
+			}
+		}
+	default:
+		return k, false, fmt.Errorf("can't dump a %s", k.Type)
+	}
+	return k, err == nil, err
+}
+
+// Every member (and value or score) of a hash, set or sorted set with HSCAN, SSCAN or ZSCAN
+func scanMembers(r redis.Conn, cmd, key string) ([]string, error) {
+	members := []string{}
+	cursor := "0"
+	for {
+		reply, err := redis.Values(r.Do(cmd, key, cursor, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		cursor, _ = redis.String(reply[0], nil)
+		page, _ := redis.Strings(reply[1], nil)
+		members = append(members, page...)
+		if cursor == "0" {
+			return members, nil
+		}
+	}
+}
+
+// Checks an archive from start to end: every CRC32, the SHA-256 and that nothing is missing
+func verifyArchive(path string) (dumpHeader, dumpEnd, error) {
+	var header dumpHeader
+	var end dumpEnd
+	f, err := os.Open(path)
+	if err != nil {
+		return header, end, err
+	}
+	defer f.Close()
+	a, err := newArchiveReader(f)
+	if err != nil {
+		return header, end, err
+	}
+	if err := a.read(chunkHeader, &header); err != nil {
+		return header, end, ErrBadArchive
+	}
+	keys, chunks := 0, 0
+	for {
+		kind, body, err := a.next()
+		if err == io.EOF {
+			return header, end, fmt.Errorf("%s is incomplete, run the dump again to finish it", path)
+		}
+		if err != nil {
+			return header, end, err
+		}
+		if kind == chunkKeys {
+			var page dumpPage
+			if err := msgpack.Unmarshal(body, &page); err != nil {
+				return header, end, ErrBadArchive
+			}
+			keys += page.count()
+			chunks++
+			continue
+		}
+		if kind != chunkEnd || msgpack.Unmarshal(body, &end) != nil {
+			return header, end, ErrBadArchive
+		}
+		if end.SHA256 != a.checksum() || end.Keys != keys || end.Chunks != chunks {
+			return header, end, fmt.Errorf("%s doesn't match its checksum", path)
+		}
+		return header, end, nil
+	}
+}
+
+// Loads an archive into the namespace name, which has to be empty. The whole archive is checked
+// before anything is written. Every key is deleted and written again a thousand values at a time,
+// so a key that was half written when a restore was interrupted is simply written again: running
+// the restore again with the same archive skips the chunks that are already in. The later parts of
+// a split key can't delete it, writing them again is safe for the other reasons in writeKey. Stream consumer
+// groups aren't part of the archive, the workers create them again and every entry that was left
+// is handed out again. Returns how many keys were restored.
+func RestoreNamespace(r redis.Conn, path, name string, progress func(int)) (int, error) {
+	if err := ValidNamespace(name); err != nil {
+		return 0, err
+	}
+	_, end, err := verifyArchive(path)
+	if err != nil {
+		return 0, err
+	}
+	prefix := NamespacePrefix(name)
+	done := 0
+	archive, err := redis.String(r.Do("HGET", prefix+restoreProgress, "archive"))
+	if err == redis.ErrNil {
+		exists := false
+		err := scanKeys(r, prefix+"*", func(string) error {
+			exists = true
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			return 0, ErrNamespaceNotEmpty
+		}
+		if _, err := r.Do("HSET", prefix+restoreProgress, "archive", end.SHA256, "chunks", 0); err != nil {
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, err
+	} else if archive != end.SHA256 {
+		return 0, fmt.Errorf("%s is in the middle of restoring another archive", name)
+	} else if done, err = redis.Int(r.Do("HGET", prefix+restoreProgress, "chunks")); err != nil {
+		return 0, err
+	}
+	if _, err := r.Do("SADD", namespacesKey(), name); err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	a, err := newArchiveReader(f)
+	if err != nil {
+		return 0, err
+	}
+	if err := a.read(chunkHeader, &dumpHeader{}); err != nil {
+		return 0, err
+	}
+	restored := 0
+	for chunk := 0; chunk < end.Chunks; chunk++ {
+		var page dumpPage
+		if err := a.read(chunkKeys, &page); err != nil {
+			return restored, err
+		}
+		if chunk < done {
+			continue
+		}
+		for _, k := range page.Keys {
+			if err := writeKey(r, prefix+k.Key, k); err != nil {
+				return restored, fmt.Errorf("%s: %v", k.Key, err)
+			}
+		}
+		if _, err := r.Do("HSET", prefix+restoreProgress, "chunks", chunk+1); err != nil {
+			return restored, err
+		}
+		if restored/10000 != (restored+page.count())/10000 {
+			progress(restored + page.count())
+		}
+		restored += page.count()
+	}
+	_, err = r.Do("DEL", prefix+restoreProgress)
+	return restored, err
+}
+
+// Writing the same part twice leaves the key as it was after the first time. Hashes, sets and
+// sorted sets don't mind, a list is cut back to where the part starts and a stream only gets the
+// entries after its last one.
+func writeKey(r redis.Conn, key string, k DumpKey) error {
+	entries := k.Entries
+	if k.Append && k.Type == "stream" {
+		last, err := lastEntryId(r, key)
+		if err != nil {
+			return err
+		}
+		entries = nil
+		for _, e := range k.Entries {
+			if entryIdAfter(e.Id, last) {
+				entries = append(entries, e)
+			}
+		}
+	}
+	if !k.Append {
+		r.Send("DEL", key)
+	} else if k.Type == "list" {
+		r.Send("LTRIM", key, 0, k.Offset-1)
+	}
+	// How many values go into one command
+	step := 1000
+	cmd := ""
+	switch k.Type {
+	case "string":
+		if len(k.Values) == 1 {
+			r.Send("SET", key, k.Values[0])
+		}
+	case "hash":
+		cmd = "HSET"
+	case "set":
+		cmd = "SADD"
+	case "list":
+		cmd = "RPUSH"
+	case "zset":
+		// ZADD wants the score first
+		for i := 0; i+1 < len(k.Values); i += 2 {
+			r.Send("ZADD", key, k.Values[i+1], k.Values[i])
+		}
+	case "stream":
+		for _, e := range entries {
+			args := []interface{}{key, e.Id}
+			for _, f := range e.Fields {
+				args = append(args, f)
+			}
+			r.Send("XADD", args...)
+		}
+	default:
+		return fmt.Errorf("can't restore a %s", k.Type)
+	}
+	if cmd != "" {
+		for i := 0; i < len(k.Values); i += step {
+			j := i + step
+			if j > len(k.Values) {
+				j = len(k.Values)
+			}
+			args := []interface{}{key}
+			for _, v := range k.Values[i:j] {
+				args = append(args, v)
+			}
+			r.Send(cmd, args...)
+		}
+	}
+	if k.TTL > 0 {
+		r.Send("PEXPIRE", key, k.TTL)
+	}
+	return flushSent(r)
+}
+
+// The id of the newest entry of a stream, "" if it's empty or doesn't exist
+func lastEntryId(r redis.Conn, key string) (string, error) {
+	entries, err := redis.Values(r.Do("XREVRANGE", key, "+", "-", "COUNT", 1))
+	if err != nil || len(entries) == 0 {
+		return "", err
+	}
+	entry, err := redis.Values(entries[0], nil)
+	if err != nil || len(entry) == 0 {
+		return "", fmt.Errorf("unexpected XREVRANGE reply")
+	}
+	return redis.String(entry[0], nil)
+}
+
+// Whether the stream entry id a ("<ms>-<seq>") comes after b. Everything comes after "".
+func entryIdAfter(a, b string) bool {
+	if b == "" {
+		return true
+	}
+	ams, aseq := splitEntryId(a)
+	bms, bseq := splitEntryId(b)
+	if ams != bms {
+		return ams > bms
+	}
+	return aseq > bseq
+}
+
+func splitEntryId(id string) (uint64, uint64) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, _ := strconv.ParseUint(parts[0], 10, 64)
+	seq := uint64(0)
+	if len(parts) == 2 {
+		seq, _ = strconv.ParseUint(parts[1], 10, 64)
+	}
+	return ms, seq
+}
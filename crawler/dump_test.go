@@ -0,0 +1,206 @@
+package crawler
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Puts one key of every type into the namespace name. The list and the stream are big enough to
+// be split when maxChunk is small.
+func fillNamespace(t *testing.T, r redis.Conn, name string) {
+	prefix := NamespacePrefix(name)
+	r.Send("SET", prefix+"highTrack", "42")
+	r.Send("PEXPIRE", prefix+"highTrack", 60000)
+	r.Send("HSET", prefix+"trackMeta:0", "1", "one", "2", "two")
+	r.Send("SADD", prefix+"crawlTracks", 3, 1, 2)
+	r.Send("ZADD", prefix+"deadBatches", 1, "a", 2, "b")
+	for i := 0; i < 100; i++ {
+		r.Send("RPUSH", prefix+"log", fmt.Sprintf("item %03d", i))
+		r.Send("XADD", prefix+"crawlTracksStream", fmt.Sprintf("%d-0", i+1), "batch", i)
+	}
+	if err := flushSent(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Every key of a namespace without its prefix and what's in it
+func namespaceSnapshot(t *testing.T, r redis.Conn, name string) map[string]string {
+	prefix := NamespacePrefix(name)
+	keys := map[string]string{}
+	err := scanKeys(r, prefix+"*", func(key string) error {
+		if strings.HasSuffix(key, restoreProgress) {
+			return nil
+		}
+		k, ok, err := readKey(r, key)
+		if err != nil || !ok {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if k.Type == "set" {
+			sort.Strings(k.Values)
+		}
+		keys[strings.TrimPrefix(key, prefix)] = fmt.Sprint(k.Type, k.TTL > 0, k.Values, k.Entries)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func sameSnapshot(t *testing.T, got, want map[string]string) {
+	if len(got) != len(want) {
+		t.Errorf("got %d keys, want %d", len(got), len(want))
+	}
+	for key, v := range want {
+		if got[key] != v {
+			t.Errorf("%s is %s, want %s", key, got[key], v)
+		}
+	}
+}
+
+func smallChunks(t *testing.T, size int) {
+	old := maxChunk
+	maxChunk = size
+	t.Cleanup(func() { maxChunk = old })
+}
+
+func TestDumpRestore(t *testing.T) {
+	smallChunks(t, 200)
+	_, r := testRedis(t)
+	fillNamespace(t, r, "prod")
+	path := filepath.Join(t.TempDir(), "prod.dump")
+
+	n, err := DumpNamespace(r, "prod", path, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("dumped %d keys, want 6", n)
+	}
+	if _, err := DumpNamespace(r, "prod", path, func(int) {}); err != ErrDumpComplete {
+		t.Errorf("dumping into a finished archive returned %v", err)
+	}
+	if n, err := RestoreNamespace(r, path, "copy", func(int) {}); err != nil || n != 6 {
+		t.Fatalf("restored %d keys (%v), want 6", n, err)
+	}
+	sameSnapshot(t, namespaceSnapshot(t, r, "copy"), namespaceSnapshot(t, r, "prod"))
+	if _, err := RestoreNamespace(r, path, "copy", func(int) {}); err != ErrNamespaceNotEmpty {
+		t.Errorf("restoring into a namespace with keys returned %v", err)
+	}
+}
+
+func TestDumpResumesTruncatedFile(t *testing.T) {
+	smallChunks(t, 200)
+	tests := []struct {
+		name string
+		cut  func(size int64) int64
+	}{
+		{"only the magic", func(size int64) int64 { return 5 }},
+		{"in the middle", func(size int64) int64 { return size / 2 }},
+		{"in the end chunk", func(size int64) int64 { return size - 3 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, r := testRedis(t)
+			fillNamespace(t, r, "prod")
+			path := filepath.Join(t.TempDir(), "prod.dump")
+			if _, err := DumpNamespace(r, "prod", path, func(int) {}); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(path, test.cut(info.Size())); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := DumpNamespace(r, "prod", path, func(int) {}); err != nil || n != 6 {
+				t.Fatalf("resumed dump has %d keys (%v), want 6", n, err)
+			}
+			if _, _, err := verifyArchive(path); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := RestoreNamespace(r, path, "copy", func(int) {}); err != nil {
+				t.Fatal(err)
+			}
+			sameSnapshot(t, namespaceSnapshot(t, r, "copy"), namespaceSnapshot(t, r, "prod"))
+		})
+	}
+}
+
+func TestRestoreRefusesCorruptArchive(t *testing.T) {
+	tests := []struct {
+		name string
+		at   func(size int64) int64
+	}{
+		{"keys chunk", func(size int64) int64 { return size / 2 }},
+		{"end chunk", func(size int64) int64 { return size - 1 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, r := testRedis(t)
+			fillNamespace(t, r, "prod")
+			path := filepath.Join(t.TempDir(), "prod.dump")
+			if _, err := DumpNamespace(r, "prod", path, func(int) {}); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b[test.at(int64(len(b)))] ^= 0xff
+			if err := ioutil.WriteFile(path, b, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := RestoreNamespace(r, path, "copy", func(int) {}); err == nil {
+				t.Fatal("restored a corrupt archive")
+			}
+			if keys := namespaceSnapshot(t, r, "copy"); len(keys) > 0 {
+				t.Errorf("wrote %d keys before the archive was checked", len(keys))
+			}
+		})
+	}
+}
+
+// A restore that was interrupted writes the parts of the chunk it was on again
+func TestWriteKeyPartTwice(t *testing.T) {
+	tests := []DumpKey{
+		{Type: "list", Values: []string{"a", "b", "c", "d"}},
+		{Type: "stream", Entries: []DumpEntry{{"1-0", []string{"batch", "1"}}, {"2-0", []string{"batch", "2"}}, {"3-0", []string{"batch", "3"}}}},
+		{Type: "hash", Values: []string{"1", "one", "2", "two"}},
+	}
+	for _, k := range tests {
+		t.Run(k.Type, func(t *testing.T) {
+			smallChunks(t, 30)
+			_, r := testRedis(t)
+			k.Key = "key"
+			for _, part := range splitKey(k) {
+				if err := writeKey(r, k.Key, part); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, _, _ := readKey(r, k.Key)
+			if len(splitKey(k)) < 2 {
+				t.Fatalf("%s wasn't split", k.Type)
+			}
+			for _, part := range splitKey(k) {
+				if !part.Append {
+					continue
+				}
+				if err := writeKey(r, k.Key, part); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, _, _ := readKey(r, k.Key)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
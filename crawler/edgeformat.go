@@ -0,0 +1,43 @@
+package crawler
+
+import (
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+)
+
+// The hashes that hold edge lists
+var EdgeHashes = []string{store.TrackCommenters, store.TrackFavoriters, store.PlaylistTracks}
+
+// Rewrites every stored edge list in format, one hash at a time with SCAN. Lists that are already
+// in format and pending playlists are left alone, so it can be stopped and run again at any time,
+// even while workers are running: a list that a worker replaced in the meantime is skipped.
+// Returns how many lists were rewritten.
+func MigrateEdges(r redis.Conn, format string, progress func(edge string, lists int)) (int, error) {
+	if err := store.ValidEdgeFormat(format); err != nil {
+		return 0, err
+	}
+	if format == "" {
+		format = store.EdgesCSV
+	}
+	total := 0
+	for _, edge := range EdgeHashes {
+		n, err := rewriteValues(r, edge, func(old []byte) ([]byte, bool, error) {
+			if store.EdgeFormat(old) == format {
+				return nil, false, nil
+			}
+			ids, err := store.DecodeEdges(old)
+			if err != nil {
+				// Leave a broken list for the next crawl of the id to fix
+				return nil, false, nil
+			}
+			v, err := store.EncodeEdges(edge, ids, format)
+			return v, err == nil, err
+		})
+		total += n
+		if err != nil {
+			return total, err
+		}
+		progress(edge, n)
+	}
+	return total, nil
+}
@@ -0,0 +1,109 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"time"
+)
+
+// A crawl with "storage" set to "bolt" runs on one machine without Redis. The graph, the queues,
+// the batch size and the seed marker all live in one bbolt file. Anything that coordinates
+// workers on different machines (control, worker listing, continuous mode, sampling, rebatching)
+// isn't available.
+var ErrNoRedis = errors.New("this crawl runs without Redis (storage is \"bolt\")")
+
+// Every connection of a crawl without Redis fails right away with ErrNoRedis so nothing tries to
+// reach a Redis server that isn't there.
+func noRedisPool() *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return nil, ErrNoRedis
+		},
+	}
+}
+
+func (c *Crawler) IsLocal() bool {
+	return c.Config.Storage == "bolt"
+}
+
+// False for "bolt" and "sqlite", the tracks, users and edge lists are in a file then
+func (c *Crawler) GraphInRedis() bool {
+	return c.Config.Storage == "" || c.Config.Storage == "redis"
+}
+
+// Same as LoadBatchSize but the size is kept in the bolt file
+func (c *Crawler) LoadLocalBatchSize(configured int) error {
+	if configured <= 0 {
+		configured = DefaultBatchSize
+	}
+	v, ok, err := c.Local.Meta(BatchSizeKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		BatchSize = configured
+		return c.Local.SetMeta(BatchSizeKey, strconv.Itoa(configured))
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid batch size %q stored in %s", v, c.Config.Path())
+	}
+	if size != configured {
+		fmt.Printf("This crawl uses a batch size of %d (configured %d).\n", size, configured)
+	}
+	BatchSize = size
+	return nil
+}
+
+// Seeding on a single machine doesn't need a lock. The seed marker is kept in the bolt file.
+func (c *Crawler) seedLocal(max_track, max_playlist int, force bool) error {
+	v, _, err := c.Local.Meta(SeedMarker)
+	if err != nil {
+		return err
+	}
+	generation, _ := strconv.Atoi(v)
+	if generation > 0 && !force {
+		return ErrAlreadySeeded
+	}
+	if err := seedBatches(nil, c.Local, nil, store.Tracks, c.TrackQueue, Selector{}, max_track); err != nil {
+		return err
+	}
+	if err := seedBatches(nil, c.Local, nil, store.Playlists, c.PlaylistQueue, Selector{}, max_playlist); err != nil {
+		return err
+	}
+	c.Local.SetMeta(SeedMarker+":at", strconv.FormatInt(time.Now().Unix(), 10))
+	return c.Local.SetMeta(SeedMarker, strconv.Itoa(generation+1))
+}
+
+// LocalQueue hands out batches from the bolt file. The Redis connection is ignored.
+type LocalQueue struct {
+	c    *Crawler
+	Name string
+}
+
+func (q *LocalQueue) Push(r redis.Conn, batch_id int) error {
+	return q.c.Local.Push(q.Name, batch_id)
+}
+
+func (q *LocalQueue) Pop(r redis.Conn) (int, error) {
+	batch_id, err := q.c.Local.Pop(q.Name)
+	if err == store.ErrEmpty {
+		return 0, ErrQueueEmpty
+	}
+	return batch_id, err
+}
+
+func (q *LocalQueue) Ack(r redis.Conn, batch_id int) error {
+	return q.c.Local.Ack(q.Name, batch_id)
+}
+
+func (q *LocalQueue) Requeue(r redis.Conn, batch_id int) error {
+	return q.c.Local.Requeue(q.Name, batch_id)
+}
+
+func (q *LocalQueue) Restart(r redis.Conn) error {
+	return q.c.Local.Restart(q.Name)
+}
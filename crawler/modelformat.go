@@ -0,0 +1,181 @@
+package crawler
+
+import (
+	"errors"
+	"github.com/Abramovic/soundclouder/models"
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+)
+
+// The hashes that hold tracks and users and what is stored in them
+var modelHashes = []struct {
+	Name string
+	New  func() interface{}
+}{
+	{"trackMeta", func() interface{} { return &models.Track{} }},
+	{"userMeta", func() interface{} { return &models.UserPreview{} }},
+}
+
+// Rewrites every stored track and user in format. Like MigrateEdges it can be stopped and run
+// again at any time and doesn't get in the way of running workers.
+func MigrateModels(r redis.Conn, format string, progress func(hash string, values int)) (int, error) {
+	if err := store.ValidModelFormat(format); err != nil {
+		return 0, err
+	}
+	if format == "" {
+		format = store.ModelsJSON
+	}
+	total := 0
+	for _, hash := range modelHashes {
+		n, err := rewriteValues(r, hash.Name, func(old []byte) ([]byte, bool, error) {
+			if store.ModelFormat(old) == format {
+				return nil, false, nil
+			}
+			model := hash.New()
+			if err := store.DecodeModel(old, model); err != nil {
+				return nil, false, nil
+			}
+			v, err := store.EncodeModel(model, format)
+			return v, err == nil, err
+		})
+		total += n
+		if err != nil {
+			return total, err
+		}
+		progress(hash.Name, n)
+	}
+	return total, nil
+}
+
+// Goes through every <prefix>:<batch> hash with SCAN and replaces each value (except pending ones)
+// with what convert returns, unless convert says to leave it or a worker changed it in the
+// meantime. Returns how many values were replaced.
+func rewriteValues(r redis.Conn, prefix string, convert func([]byte) ([]byte, bool, error)) (int, error) {
+	if err := swapScript.Load(r); err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	err := scanKeys(r, Key(prefix)+":*", func(key string) error {
+		values, err := redis.StringMap(r.Do("HGETALL", key))
+		if err != nil {
+			return err
+		}
+		for field, v := range values {
+			if v == "null" {
+				continue
+			}
+			old := []byte(v)
+			value, ok, err := convert(old)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			swapped, err := redis.Int(swapScript.Do(r, key, field, sha1hex(old), value))
+			if err != nil {
+				return err
+			}
+			rewritten += swapped
+		}
+		return nil
+	})
+	return rewritten, err
+}
+
+// How much room a sample of stored values takes up in one format
+type ModelSize struct {
+	Hash   string
+	Format string
+	Values int
+	// The values themselves
+	Bytes int64
+	// What Redis says the hashes holding them take up, -1 if it can't tell (MEMORY USAGE needs
+	// Redis 4)
+	RedisBytes int64
+}
+
+var errSampled = errors.New("sampled enough")
+
+// Reads up to sample tracks and users, writes them into scratch hashes under the bench prefix in
+// every format and measures them. The scratch hashes are bucketed like the real ones so Redis
+// picks the same encoding for them.
+func ModelReport(r redis.Conn, sample int) ([]ModelSize, error) {
+	sizes := []ModelSize{}
+	for _, hash := range modelHashes {
+		values := map[string]map[string][]byte{} // batch -> id -> value
+		n := 0
+		err := scanKeys(r, Key(hash.Name)+":*", func(key string) error {
+			fields, err := redis.StringMap(r.Do("HGETALL", key))
+			if err != nil {
+				return err
+			}
+			batch := key[len(Key(hash.Name))+1:]
+			for field, v := range fields {
+				if v == "null" {
+					continue
+				}
+				if values[batch] == nil {
+					values[batch] = map[string][]byte{}
+				}
+				values[batch][field] = []byte(v)
+				if n++; n >= sample {
+					return errSampled
+				}
+			}
+			return nil
+		})
+		if err != nil && err != errSampled {
+			return nil, err
+		}
+		for _, format := range store.ModelFormats {
+			size, err := measureModels(r, hash.Name, hash.New, format, values)
+			if err != nil {
+				return nil, err
+			}
+			size.Values = n
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes, nil
+}
+
+func measureModels(r redis.Conn, name string, newModel func() interface{}, format string, values map[string]map[string][]byte) (ModelSize, error) {
+	size := ModelSize{Hash: name, Format: format}
+	prefix := Key(BenchPrefix + "models:" + format + ":" + name)
+	defer scanKeys(r, prefix+":*", func(key string) error {
+		_, err := r.Do("DEL", key)
+		return err
+	})
+	for batch, fields := range values {
+		args := []interface{}{prefix + ":" + batch}
+		for field, old := range fields {
+			model := newModel()
+			if err := store.DecodeModel(old, model); err != nil {
+				continue
+			}
+			v, err := store.EncodeModel(model, format)
+			if err != nil {
+				return size, err
+			}
+			size.Bytes += int64(len(v))
+			args = append(args, field, v)
+		}
+		if len(args) == 1 {
+			continue
+		}
+		if _, err := r.Do("HSET", args...); err != nil {
+			return size, err
+		}
+		if size.RedisBytes < 0 {
+			continue
+		}
+		used, err := redis.Int64(r.Do("MEMORY", "USAGE", args[0], "SAMPLES", 0))
+		if err != nil {
+			size.RedisBytes = -1
+			continue
+		}
+		size.RedisBytes += used
+	}
+	return size, nil
+}
@@ -0,0 +1,252 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Every namespace that was ever used on this Redis. It is the only key that is never prefixed, on
+// a cluster it only gets ClusterTag (see namespacesKey).
+const NamespacesKey = "namespaces"
+
+// The namespace of this process. Empty means the keys have no prefix at all, which is how every
+// crawl was stored before there were namespaces.
+var Namespace = ""
+
+// Whether we talk to a Redis Cluster, it changes the prefix of every namespace (see SetNamespace)
+var Cluster = false
+
+var ErrNamespaceNotEmpty = errors.New("the target namespace already has keys, delete it first")
+
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Names that would make a namespace look like the keys of a crawl without one
+var reservedNamespaces = []string{
+	NamespacesKey, Workers, "worker", "sample", "bench", "reconcile", "deadBatches", ControlChannel, ControlState,
+	"crawlTracks", "crawlTracksTodo", "crawlTracksStream",
+	"crawlPlaylists", "crawlPlaylistsTodo", "crawlPlaylistsStream",
+}
+
+func ValidNamespace(name string) error {
+	if !namespaceName.MatchString(name) {
+		return fmt.Errorf("invalid namespace %q, only letters, digits, - and _ are allowed", name)
+	}
+	names := append(append(reservedNamespaces, BatchedHashes...), BatchedBitmaps...)
+	for _, reserved := range names {
+		if name == reserved {
+			return fmt.Errorf("%q is already used as a key name and can't be a namespace", name)
+		}
+	}
+	return nil
+}
+
+// The keys of one namespace. The crawl without a namespace ("") has no prefix, so its keys are every
+// key that isn't the list of namespaces or in one of them. The reserved names make sure none of its
+// keys looks like it's in a namespace.
+type namespaceKeys struct {
+	prefix string
+	others []string
+}
+
+// Only the crawl without a namespace can be read without being a valid namespace name, it can
+// be copied and dumped but nothing is written into it.
+func sourceKeys(r redis.Conn, name string) (namespaceKeys, error) {
+	keys := namespaceKeys{prefix: NamespacePrefix(name)}
+	if name != "" {
+		return keys, ValidNamespace(name)
+	}
+	if keys.prefix != "" {
+		// On a cluster even the crawl without a namespace has the hash tag in front
+		return keys, nil
+	}
+	names, err := redis.Strings(r.Do("SMEMBERS", namespacesKey()))
+	if err != nil {
+		return namespaceKeys{}, err
+	}
+	for _, name := range names {
+		keys.others = append(keys.others, NamespacePrefix(name))
+	}
+	return keys, nil
+}
+
+// What to SCAN for
+func (n namespaceKeys) pattern() string {
+	return n.prefix + "*"
+}
+
+// Whether a key that matched the pattern is really in the namespace
+func (n namespaceKeys) has(key string) bool {
+	if key == namespacesKey() {
+		return false
+	}
+	if n.prefix != "" {
+		return true
+	}
+	for _, other := range n.others {
+		if strings.HasPrefix(key, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// Decides what goes in front of every key
+func SetNamespace(namespace string, cluster bool) {
+	Namespace = namespace
+	Cluster = cluster
+	KeyPrefix = NamespacePrefix(namespace)
+}
+
+// What goes in front of every key of a namespace. On a cluster the namespace doubles as the hash
+// tag so each namespace lives in a slot of its own.
+func NamespacePrefix(name string) string {
+	switch {
+	case Cluster && name != "":
+		return "{" + name + "}:"
+	case Cluster:
+		return ClusterTag + ":"
+	case name != "":
+		return name + ":"
+	}
+	return ""
+}
+
+// The list of namespaces. On a cluster our connections go to the node of our namespace, so the
+// list gets the hash tag of the crawl without a namespace to be in one slot for everybody.
+func namespacesKey() string {
+	if Cluster {
+		return ClusterTag + ":" + NamespacesKey
+	}
+	return NamespacesKey
+}
+
+// Adds the namespace of this process to the list of namespaces. On a cluster the list is most
+// likely on another node than our keys, so it gets a connection of its own.
+func (c *Crawler) RegisterNamespace() error {
+	if Namespace == "" {
+		return nil
+	}
+	var r redis.Conn
+	var err error
+	if Cluster {
+		addr := net.JoinHostPort(c.Config.Host, strconv.Itoa(c.Config.RedisPort()))
+		r, err = dialClusterNode(c.Config, addr, ClusterTag)
+	} else {
+		r, err = c.RedisClient.Get(), nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = r.Do("SADD", namespacesKey(), Namespace)
+	return err
+}
+
+// Every known namespace and how many keys it has
+func ListNamespaces(r redis.Conn) (map[string]int, error) {
+	names, err := redis.Strings(r.Do("SMEMBERS", namespacesKey()))
+	if err != nil {
+		return nil, err
+	}
+	namespaces := map[string]int{}
+	for _, name := range names {
+		n := 0
+		err := scanKeys(r, NamespacePrefix(name)+"*", func(string) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		namespaces[name] = n
+	}
+	return namespaces, nil
+}
+
+// Copies every key of one namespace into another with DUMP and RESTORE, keeping the expiry of
+// keys like the worker hashes. The target has to be empty so a copy never mixes two crawls. from
+// can be "" to copy the crawl without a namespace.
+func CopyNamespace(r redis.Conn, from, to string, progress func(int)) (int, error) {
+	source, err := sourceKeys(r, from)
+	if err != nil {
+		return 0, err
+	}
+	if err := ValidNamespace(to); err != nil {
+		return 0, err
+	}
+	exists := false
+	err = scanKeys(r, NamespacePrefix(to)+"*", func(string) error {
+		exists = true
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, ErrNamespaceNotEmpty
+	}
+	if _, err := r.Do("SADD", namespacesKey(), to); err != nil {
+		return 0, err
+	}
+	// The new namespace isn't part of the crawl without one, or its copied keys would be copied again
+	source.others = append(source.others, NamespacePrefix(to))
+	copied := 0
+	err = scanKeys(r, source.pattern(), func(key string) error {
+		if !source.has(key) {
+			return nil
+		}
+		dump, err := redis.Bytes(r.Do("DUMP", key))
+		if err == redis.ErrNil {
+			// Expired or deleted since SCAN returned it
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ttl, err := redis.Int64(r.Do("PTTL", key))
+		if err != nil {
+			return err
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+		target := NamespacePrefix(to) + strings.TrimPrefix(key, source.prefix)
+		if _, err := r.Do("RESTORE", target, ttl, dump, "REPLACE"); err != nil {
+			return err
+		}
+		copied++
+		if copied%10000 == 0 {
+			progress(copied)
+		}
+		return nil
+	})
+	return copied, err
+}
+
+// Deletes every key of a namespace and forgets about it
+func DeleteNamespace(r redis.Conn, name string, progress func(int)) (int, error) {
+	if err := ValidNamespace(name); err != nil {
+		return 0, err
+	}
+	deleted := 0
+	err := scanKeys(r, NamespacePrefix(name)+"*", func(key string) error {
+		if _, err := r.Do("DEL", key); err != nil {
+			return err
+		}
+		deleted++
+		if deleted%10000 == 0 {
+			progress(deleted)
+		}
+		return nil
+	})
+	if err != nil {
+		return deleted, err
+	}
+	_, err = r.Do("SREM", namespacesKey(), name)
+	return deleted, err
+}
@@ -0,0 +1,26 @@
+package crawler
+
+import "testing"
+
+func TestNamespacePrefix(t *testing.T) {
+	defer SetNamespace("", false)
+	tests := []struct {
+		name    string
+		cluster bool
+		want    string
+	}{
+		{"", false, ""},
+		{"test", false, "test:"},
+		{"", true, ClusterTag + ":"},
+		{"test", true, "{test}:"},
+	}
+	for _, test := range tests {
+		SetNamespace(test.name, test.cluster)
+		if got := NamespacePrefix(test.name); got != test.want {
+			t.Errorf("namespace %q (cluster %v) has prefix %q, want %q", test.name, test.cluster, got, test.want)
+		}
+		if KeyPrefix != test.want {
+			t.Errorf("namespace %q (cluster %v) sets KeyPrefix %q, want %q", test.name, test.cluster, KeyPrefix, test.want)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by Pop when there is nothing left to crawl
+var ErrQueueEmpty = errors.New("queue is empty")
+
+// A Queue hands out batches of tracks or playlists to the workers. A batch that was popped stays
+// on record as in progress until it is acked so it can be crawled again if the worker dies.
+type Queue interface {
+	Push(r redis.Conn, batch_id int) error
+	Pop(r redis.Conn) (int, error)
+	Ack(r redis.Conn, batch_id int) error
+	// Gives a batch that was popped but never crawled back to the queue
+	Requeue(r redis.Conn, batch_id int) error
+	// Puts every batch that was popped but never acked back onto the queue
+	Restart(r redis.Conn) error
+}
+
+// Creates the queue for "tracks" or "playlists" depending on the "queue" setting in the config.
+// A run that only crawls part of the ids passes its selector so it gets queues of its own.
+func (c *Crawler) NewQueue(kind string, sel Selector) Queue {
+	name := "crawl" + strings.Title(kind)
+	suffix := ""
+	if sel.IsSet() {
+		suffix = ":" + sel.String()
+	}
+	if c.IsLocal() {
+		return &LocalQueue{c: c, Name: name + suffix}
+	}
+	if c.Config.Queue == "stream" {
+		return &StreamQueue{
+			Stream:     Key(name + "Stream" + suffix),
+			Queued:     Key(name + "StreamQueued" + suffix),
+			Group:      "crawlers",
+			Consumer:   WorkerId(),
+			ClaimAfter: c.Config.ClaimAfter(),
+			pending:    map[int]string{},
+		}
+	}
+	return &SetQueue{Key: Key(name + suffix), Todo: Key(name + "Todo" + suffix)}
+}
+
+// SetQueue is the original queue: batches are popped from one set and kept in a todo set until
+// they are finished.
+type SetQueue struct {
+	Key  string
+	Todo string
+}
+
+func (q *SetQueue) Push(r redis.Conn, batch_id int) error {
+	_, err := r.Do("SADD", q.Key, batch_id)
+	return err
+}
+
+func (q *SetQueue) Pop(r redis.Conn) (int, error) {
+	i, err := redis.Int(r.Do("SPOP", q.Key))
+	if err == redis.ErrNil {
+		return 0, ErrQueueEmpty
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = r.Do("SADD", q.Todo, i)
+	return i, err
+}
+
+func (q *SetQueue) Ack(r redis.Conn, batch_id int) error {
+	_, err := r.Do("SREM", q.Todo, batch_id)
+	return err
+}
+
+func (q *SetQueue) Requeue(r redis.Conn, batch_id int) error {
+	r.Send("MULTI")
+	r.Send("SADD", q.Key, batch_id)
+	r.Send("SREM", q.Todo, batch_id)
+	_, err := r.Do("EXEC")
+	return err
+}
+
+func (q *SetQueue) Restart(r redis.Conn) error {
+	batches, err := redis.Ints(r.Do("SMEMBERS", q.Todo))
+	if err != nil {
+		return err
+	}
+	for _, i := range batches {
+		if err := q.Push(r, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StreamQueue uses a Redis Stream with a consumer group. Redis keeps track of which worker holds
+// which batch and entries that nobody acked for ClaimAfter are taken over by the next worker
+// that asks for work (this needs Redis 6.2 or newer).
+type StreamQueue struct {
+	Stream string
+	// A bit per batch that is on the stream and not acked yet. A stream is a log, not a set, so
+	// without it seeding a batch twice would crawl it twice.
+	Queued     string
+	Group      string
+	Consumer   string
+	ClaimAfter time.Duration
+
+	once sync.Once
+	mu   sync.Mutex
+	// Stream entry ids of the batches this worker is crawling so they can be acked
+	pending map[int]string
+}
+
+func (q *StreamQueue) createGroup(r redis.Conn) {
+	q.once.Do(func() {
+		// Start at 0 so the group sees everything that was added before it existed
+		_, err := r.Do("XGROUP", "CREATE", q.Stream, q.Group, "0", "MKSTREAM")
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			fmt.Println(err)
+		}
+	})
+}
+
+// Only adds the batch (ARGV[1]) to the stream (KEYS[1]) if its bit in KEYS[2] isn't set yet
+var streamPushScript = redis.NewScript(2, `
+if redis.call("SETBIT", KEYS[2], ARGV[1], 1) == 0 then
+	redis.call("XADD", KEYS[1], "*", "batch", ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// Takes the entry (ARGV[2]) of a batch (ARGV[3]) away from whoever holds it and puts the batch
+// back at the end of the stream as a new entry.
+var streamRequeueScript = redis.NewScript(2, `
+redis.call("XACK", KEYS[1], ARGV[1], ARGV[2])
+redis.call("XDEL", KEYS[1], ARGV[2])
+redis.call("XADD", KEYS[1], "*", "batch", ARGV[3])
+redis.call("SETBIT", KEYS[2], ARGV[3], 1)
+return 1
+`)
+
+// A batch that is already on the stream (handed out or not) isn't added again.
+func (q *StreamQueue) Push(r redis.Conn, batch_id int) error {
+	_, err := streamPushScript.Do(r, q.Stream, q.Queued, batch_id)
+	return err
+}
+
+func (q *StreamQueue) Pop(r redis.Conn) (int, error) {
+	q.createGroup(r)
+	// Take over anything a dead worker left behind before starting on new batches
+	reply, err := redis.Values(r.Do("XAUTOCLAIM", q.Stream, q.Group, q.Consumer,
+		int64(q.ClaimAfter/time.Millisecond), "0-0", "COUNT", 1))
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) >= 2 {
+		if id, batch_id, ok := firstEntry(reply[1]); ok {
+			return q.track(id, batch_id), nil
+		}
+	}
+
+	reply, err = redis.Values(r.Do("XREADGROUP", "GROUP", q.Group, q.Consumer, "COUNT", 1, "STREAMS", q.Stream, ">"))
+	if err == redis.ErrNil {
+		return 0, ErrQueueEmpty
+	}
+	if err != nil {
+		return 0, err
+	}
+	// [[stream, [[id, [field, value]]]]]
+	for _, s := range reply {
+		stream, err := redis.Values(s, nil)
+		if err != nil || len(stream) < 2 {
+			continue
+		}
+		if id, batch_id, ok := firstEntry(stream[1]); ok {
+			return q.track(id, batch_id), nil
+		}
+	}
+	return 0, ErrQueueEmpty
+}
+
+func (q *StreamQueue) track(id string, batch_id int) int {
+	q.mu.Lock()
+	q.pending[batch_id] = id
+	q.mu.Unlock()
+	return batch_id
+}
+
+func (q *StreamQueue) Ack(r redis.Conn, batch_id int) error {
+	q.mu.Lock()
+	id, ok := q.pending[batch_id]
+	delete(q.pending, batch_id)
+	q.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if _, err := r.Do("XACK", q.Stream, q.Group, id); err != nil {
+		return err
+	}
+	// Nobody needs the entry once it's acked so keep the stream from growing forever
+	if _, err := r.Do("XDEL", q.Stream, id); err != nil {
+		return err
+	}
+	_, err := r.Do("SETBIT", q.Queued, batch_id, 0)
+	return err
+}
+
+// Push would skip the batch because its bit is still set, so the pending entry is moved to the end
+// of the stream instead.
+func (q *StreamQueue) Requeue(r redis.Conn, batch_id int) error {
+	q.mu.Lock()
+	id, ok := q.pending[batch_id]
+	delete(q.pending, batch_id)
+	q.mu.Unlock()
+	if !ok {
+		return q.Push(r, batch_id)
+	}
+	_, err := streamRequeueScript.Do(r, q.Stream, q.Queued, q.Group, id, batch_id)
+	return err
+}
+
+// Puts every batch that was handed out but never acked back onto the stream right away instead of
+// waiting for it to be idle for ClaimAfter.
+func (q *StreamQueue) Restart(r redis.Conn) error {
+	q.createGroup(r)
+	for {
+		// [[id, consumer, idle, deliveries], ...]
+		pending, err := redis.Values(r.Do("XPENDING", q.Stream, q.Group, "-", "+", 100))
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		for _, p := range pending {
+			info, err := redis.Values(p, nil)
+			if err != nil || len(info) == 0 {
+				continue
+			}
+			id, err := redis.String(info[0], nil)
+			if err != nil {
+				continue
+			}
+			entry, err := redis.Values(r.Do("XRANGE", q.Stream, id, id))
+			if err != nil {
+				return err
+			}
+			_, batch_id, ok := firstEntry(entry)
+			if !ok {
+				// The entry was deleted while it was still pending, there is nothing to put back
+				if _, err := r.Do("XACK", q.Stream, q.Group, id); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := streamRequeueScript.Do(r, q.Stream, q.Queued, q.Group, id, batch_id); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Reads the first [id, [field, value...]] entry out of a list of stream entries.
+func firstEntry(reply interface{}) (string, int, bool) {
+	entries, err := redis.Values(reply, nil)
+	if err != nil {
+		return "", 0, false
+	}
+	for _, e := range entries {
+		entry, err := redis.Values(e, nil)
+		if err != nil || len(entry) < 2 {
+			continue
+		}
+		id, err := redis.String(entry[0], nil)
+		if err != nil {
+			continue
+		}
+		fields, err := redis.StringMap(entry[1], nil)
+		if err != nil {
+			// The entry was deleted while it was still pending
+			continue
+		}
+		batch_id, err := strconv.Atoi(fields["batch"])
+		if err != nil {
+			continue
+		}
+		return id, batch_id, true
+	}
+	return "", 0, false
+}
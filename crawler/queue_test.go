@@ -0,0 +1,72 @@
+package crawler
+
+import (
+	"github.com/Abramovic/soundclouder/config"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"testing"
+)
+
+// Pops until the queue is empty and acks everything it got
+func drain(t *testing.T, r redis.Conn, q Queue) []int {
+	batches := []int{}
+	for {
+		b, err := q.Pop(r)
+		if err == ErrQueueEmpty {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Ack(r, b); err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, b)
+	}
+	sort.Ints(batches)
+	return batches
+}
+
+func TestQueues(t *testing.T) {
+	for _, queue := range []string{"set", "stream"} {
+		t.Run(queue, func(t *testing.T) {
+			_, r := testRedis(t)
+			c := &Crawler{Config: config.Configuration{Queue: queue}}
+			q := c.NewQueue("tracks", Selector{})
+
+			for _, b := range []int{5, 5, 7} {
+				if err := q.Push(r, b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// A batch that's out is pushed again, then given back without being crawled
+			b, err := q.Pop(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.Push(r, b)
+			if err := q.Requeue(r, b); err != nil {
+				t.Fatal(err)
+			}
+			if got := drain(t, r, q); len(got) != 2 || got[0] != 5 || got[1] != 7 {
+				t.Errorf("crawled %v, want 5 and 7 once each", got)
+			}
+
+			// A worker dies with a batch that was never acked
+			q.Push(r, 9)
+			if _, err := q.Pop(r); err != nil {
+				t.Fatal(err)
+			}
+			q = c.NewQueue("tracks", Selector{})
+			if got := drain(t, r, q); len(got) != 0 {
+				t.Errorf("crawled %v before the restart", got)
+			}
+			if err := q.Restart(r); err != nil {
+				t.Fatal(err)
+			}
+			if got := drain(t, r, q); len(got) != 1 || got[0] != 9 {
+				t.Errorf("crawled %v after the restart, want 9", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package crawler
+
+import (
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The counts that Reconcile works out from the edge lists are added up in
+// reconcile:<counter>:<batch> hashes before they are compared. They are deleted again at the end.
+const ReconcilePrefix = "reconcile:"
+
+// A counter that doesn't match the edge lists. Counted is what the lists say.
+type CounterDiff struct {
+	Counter string
+	Id      int
+	Stored  int
+	Counted int
+}
+
+// How far one counter is off. Drift is the sum of Stored - Counted over every wrong id, so a
+// counter that counted the same edges twice has a positive drift.
+type CounterReport struct {
+	Counter string
+	Ids     int
+	Wrong   int
+	Drift   int
+}
+
+// Works out every trackCount* counter again from the edge lists and compares it to what is stored.
+// diff is called for every id that is off. With fix the stored counters are rewritten to match.
+// Only the lists of live ids count. Dead ids keep their lists (see tombstones) but the workers take
+// them out of the counters when an id is buried and put them back when it comes back to life. Run
+// it with the workers drained, a worker storing a list in the middle of it makes that counter look
+// wrong.
+func Reconcile(r redis.Conn, fix bool, diff func(CounterDiff)) ([]CounterReport, error) {
+	reports := []CounterReport{}
+	for _, edge := range EdgeHashes {
+		report, err := reconcileEdge(r, edge, fix, diff)
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func reconcileEdge(r redis.Conn, edge string, fix bool, diff func(CounterDiff)) (CounterReport, error) {
+	counter, perMember := store.EdgeCounter(edge)
+	scratch := Key(ReconcilePrefix + counter)
+	if err := deleteKeys(r, scratch+":*"); err != nil {
+		return CounterReport{}, err
+	}
+	// The counts are only needed until they are compared, whether that worked or not
+	defer deleteKeys(r, scratch+":*")
+	kind := edgeKind(edge)
+	err := scanKeys(r, Key(edge)+":*", func(key string) error {
+		lists, err := redis.StringMap(r.Do("HGETALL", key))
+		if err != nil {
+			return err
+		}
+		// The lists of a batch belong to the ids of the same batch
+		batch := key[strings.LastIndex(key, ":"):]
+		dead, err := redis.Bytes(r.Do("GET", Key(crawlPrefixes[kind]+stateDead)+batch))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		for field, v := range lists {
+			id, err := strconv.Atoi(field)
+			if err != nil || bitSet(dead, id%BatchSize) {
+				continue
+			}
+			ids, err := store.DecodeEdges([]byte(v))
+			if err != nil {
+				continue
+			}
+			// Duplicates only count once, same as in the workers
+			unique, _ := store.EdgeDiff(nil, ids)
+			if !perMember {
+				if len(unique) > 0 {
+					key, hkey := RedisKey(ReconcilePrefix+counter, id)
+					r.Send("HSET", key, hkey, len(unique))
+				}
+				continue
+			}
+			for _, member := range unique {
+				key, hkey := RedisKey(ReconcilePrefix+counter, member)
+				r.Send("HINCRBY", key, hkey, 1)
+			}
+		}
+		return flushSent(r)
+	})
+	if err != nil {
+		return CounterReport{}, err
+	}
+	return compareCounter(r, counter, fix, diff)
+}
+
+// Whether tracks or playlists own the lists of an edge
+func edgeKind(edge string) string {
+	for _, kind := range []string{store.Tracks, store.Playlists} {
+		for _, e := range store.KindEdges(kind) {
+			if e == edge {
+				return kind
+			}
+		}
+	}
+	return ""
+}
+
+// Whether the bit at offset is set in a bitmap read with GET, counting like setBits
+func bitSet(b []byte, offset int) bool {
+	if offset/8 >= len(b) {
+		return false
+	}
+	return b[offset/8]&(0x80>>uint(offset%8)) != 0
+}
+
+// Goes through every batch that has either a stored or a counted value
+func compareCounter(r redis.Conn, counter string, fix bool, diff func(CounterDiff)) (CounterReport, error) {
+	report := CounterReport{Counter: counter}
+	batches := map[int]bool{}
+	for _, prefix := range []string{Key(counter), Key(ReconcilePrefix + counter)} {
+		err := scanKeys(r, prefix+":*", func(key string) error {
+			if batch_id, err := strconv.Atoi(key[strings.LastIndex(key, ":")+1:]); err == nil {
+				batches[batch_id] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	sorted := []int{}
+	for batch_id := range batches {
+		sorted = append(sorted, batch_id)
+	}
+	sort.Ints(sorted)
+	for _, batch_id := range sorted {
+		key := Key(counter) + ":" + strconv.Itoa(batch_id)
+		stored, err := redis.IntMap(r.Do("HGETALL", key))
+		if err != nil {
+			return report, err
+		}
+		counted, err := redis.IntMap(r.Do("HGETALL", Key(ReconcilePrefix+counter)+":"+strconv.Itoa(batch_id)))
+		if err != nil {
+			return report, err
+		}
+		fields := []string{}
+		for field := range stored {
+			fields = append(fields, field)
+		}
+		for field := range counted {
+			if _, ok := stored[field]; !ok {
+				fields = append(fields, field)
+			}
+		}
+		sort.Strings(fields)
+		queued := false
+		for _, field := range fields {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				continue
+			}
+			report.Ids++
+			if stored[field] == counted[field] {
+				continue
+			}
+			report.Wrong++
+			report.Drift += stored[field] - counted[field]
+			diff(CounterDiff{Counter: counter, Id: id, Stored: stored[field], Counted: counted[field]})
+			if !fix {
+				continue
+			}
+			if counted[field] == 0 {
+				r.Send("HDEL", key, field)
+			} else {
+				r.Send("HSET", key, field, counted[field])
+			}
+			queued = true
+		}
+		if queued {
+			if err := flushSent(r); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+func deleteKeys(r redis.Conn, pattern string) error {
+	return scanKeys(r, pattern, func(key string) error {
+		_, err := r.Do("DEL", key)
+		return err
+	})
+}
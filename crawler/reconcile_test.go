@@ -0,0 +1,43 @@
+package crawler
+
+import (
+	"github.com/Abramovic/soundclouder/store"
+	"testing"
+	"time"
+)
+
+func TestReconcileSkipsDeadIds(t *testing.T) {
+	_, r := testRedis(t)
+	s := NewRedisStore(r, 0)
+	s.AddPending(store.Tracks, []int{1, 2})
+	s.PutEdges(store.TrackFavoriters, 1, []int{7, 8})
+	s.PutEdges(store.TrackFavoriters, 2, []int{7, 8, 9})
+	// Buried without going through Crawler.Bury, so its list still counts
+	s.MarkDead(store.Tracks, 2, store.DeadDeleted, time.Now())
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs := map[int]CounterDiff{}
+	reports, err := Reconcile(r, true, func(d CounterDiff) {
+		diffs[d.Id] = d
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[2].Stored != 3 || diffs[2].Counted != 0 {
+		t.Errorf("got diffs %+v, want track 2 stored 3 counted 0", diffs)
+	}
+	for _, report := range reports {
+		if report.Counter == store.TrackCountFavoriters && report.Drift != 3 {
+			t.Errorf("%s drifted %+d, want +3", report.Counter, report.Drift)
+		}
+	}
+	// fix took the dead list out
+	_, err = Reconcile(r, false, func(d CounterDiff) {
+		t.Errorf("%s %d is still off after fix: %+v", d.Counter, d.Id, d)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,185 @@
+package crawler
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/Abramovic/soundclouder/config"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The hash tag every key gets on a Redis Cluster without a namespace. Everything between the
+// braces decides the slot, so all keys of the crawl end up on the same node.
+const ClusterTag = "{soundclouder}"
+
+// Put in front of every key, see SetNamespace. Empty for a crawl without a namespace.
+var KeyPrefix = ""
+
+// Every Redis key goes through Key so the prefix is applied in one place.
+func Key(name string) string {
+	return KeyPrefix + name
+}
+
+// Creates a pointer to a pool of Redis connections. Depending on the config a new connection is
+// made straight to host:port, to the master the sentinels point at or to the cluster node that
+// owns the slot of our keys.
+func CreateRedisClient(config config.Configuration) *redis.Pool {
+	maxActive := config.MaxActive
+	if maxActive <= 0 {
+		maxActive = 1000
+	}
+	// Keep about a connection per worker around so a Get doesn't have to dial (and go through TLS
+	// and the sentinels) every time
+	maxIdle := config.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = config.MaxWorkers
+		if maxIdle <= 0 {
+			maxIdle = 200
+		}
+	}
+	if maxIdle > maxActive {
+		maxIdle = maxActive
+	}
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.RedisPort()))
+	return &redis.Pool{
+		MaxIdle:     maxIdle,
+		MaxActive:   maxActive,
+		IdleTimeout: config.Idle(),
+		Dial: func() (redis.Conn, error) {
+			if len(config.Sentinels) > 0 {
+				return dialSentinelMaster(config)
+			}
+			if config.Cluster {
+				return dialClusterNode(config, addr, strings.TrimSuffix(KeyPrefix, ":"))
+			}
+			return dialRedis(config, addr, config.Password)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+func dialRedis(config config.Configuration, addr, password string) (redis.Conn, error) {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(10 * time.Second),
+		redis.DialPassword(password),
+		redis.DialDatabase(config.Database),
+	}
+	if config.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+		options = append(options,
+			redis.DialUseTLS(true),
+			redis.DialTLSSkipVerify(config.TLSSkipVerify),
+			redis.DialTLSConfig(&tls.Config{ServerName: host}),
+		)
+	}
+	return redis.Dial("tcp", addr, options...)
+}
+
+// Asks the sentinels one after the other where the master is and connects to it. The sentinels
+// are asked again for every new connection so the pool follows a failover.
+func dialSentinelMaster(config config.Configuration) (redis.Conn, error) {
+	if config.SentinelMaster == "" {
+		return nil, errors.New("sentinels are set but sentinel_master is missing")
+	}
+	var lastErr error
+	for _, sentinel := range config.Sentinels {
+		s, err := dialRedis(config, sentinel, config.SentinelPassword)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		master, err := redis.Strings(s.Do("SENTINEL", "get-master-addr-by-name", config.SentinelMaster))
+		s.Close()
+		if err != nil || len(master) != 2 {
+			lastErr = fmt.Errorf("sentinel %s doesn't know master %s", sentinel, config.SentinelMaster)
+			continue
+		}
+		c, err := dialRedis(config, net.JoinHostPort(master[0], master[1]), config.Password)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// Right after a failover a sentinel can still hand out the old master
+		role, err := redis.Values(c.Do("ROLE"))
+		if err == nil && len(role) > 0 {
+			if r, _ := redis.String(role[0], nil); r != "master" {
+				c.Close()
+				lastErr = fmt.Errorf("%s:%s is a %s, not the master", master[0], master[1], r)
+				continue
+			}
+		}
+		return c, nil
+	}
+	return nil, lastErr
+}
+
+// Connects to any node of the cluster, finds out which node owns the slot of the hash tag and
+// connects to that one instead. Every key carries our tag so one connection can do everything.
+func dialClusterNode(config config.Configuration, addr, tag string) (redis.Conn, error) {
+	c, err := dialRedis(config, addr, config.Password)
+	if err != nil {
+		return nil, err
+	}
+	slot, err := redis.Int(c.Do("CLUSTER", "KEYSLOT", tag))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	ranges, err := redis.Values(c.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	// Every range is [first slot, last slot, [master ip, port, ...], replicas...]
+	for _, r := range ranges {
+		info, err := redis.Values(r, nil)
+		if err != nil || len(info) < 3 {
+			continue
+		}
+		first, _ := redis.Int(info[0], nil)
+		last, _ := redis.Int(info[1], nil)
+		if slot < first || slot > last {
+			continue
+		}
+		master, err := redis.Values(info[2], nil)
+		if err != nil || len(master) < 2 {
+			break
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		owner := net.JoinHostPort(host, strconv.Itoa(port))
+		if owner == addr || host == "" {
+			return c, nil
+		}
+		c.Close()
+		return dialRedis(config, owner, config.Password)
+	}
+	c.Close()
+	return nil, fmt.Errorf("no node in the cluster owns slot %d", slot)
+}
+
+// Sends everything that was queued with Send and returns the first error that any of the commands
+// got back. Do("") on its own only fails if the connection does, the errors of the commands are
+// inside the replies.
+func flushSent(r redis.Conn) error {
+	replies, err := redis.Values(r.Do(""))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package crawler
+
+import (
+	"github.com/alicebob/miniredis"
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+// A Redis of its own for every test
+func testRedis(t *testing.T) (*miniredis.Miniredis, redis.Conn) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := redis.Dial("tcp", m.Addr())
+	if err != nil {
+		m.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		r.Close()
+		m.Close()
+	})
+	return m, r
+}
@@ -0,0 +1,269 @@
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Everything a sample crawl stores lives under this prefix so it never mixes with the full crawl.
+const SamplePrefix = "sample:"
+
+// What we measure for every sampled id. "live" is 1 if the id turned out to be a public track or
+// playlist. A unit (an id, or a whole batch when sampling by batch) stores the sum of each metric.
+var SampleMetrics = map[string][]string{
+	"tracks":    {"live", "favorites", "comments", "playbacks"},
+	"playlists": {"live", "tracks"},
+}
+
+var ErrNoSample = errors.New("no sample has been taken yet")
+
+// A Sample is a uniform random subset of ids (By "ids") or of whole batches (By "batches").
+// The seed is stored with the sample so running it again picks the same units and only crawls
+// the ones that are still missing.
+type Sample struct {
+	Kind       string  `json:"kind"`
+	By         string  `json:"by"`
+	Rate       float64 `json:"rate"`
+	Population int     `json:"population"` // The highest id
+	Seed       int64   `json:"seed"`
+}
+
+func sampleKey(kind, what string) string {
+	return Key(fmt.Sprintf("%s%s:%s", SamplePrefix, kind, what))
+}
+
+func SaveSample(r redis.Conn, s Sample) error {
+	j, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = r.Do("SET", sampleKey(s.Kind, "config"), string(j))
+	return err
+}
+
+func LoadSample(r redis.Conn, kind string) (Sample, error) {
+	var s Sample
+	j, err := redis.Bytes(r.Do("GET", sampleKey(kind, "config")))
+	if err == redis.ErrNil {
+		return s, ErrNoSample
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(j, &s)
+	return s, err
+}
+
+// The number of units in the whole population
+func (s Sample) PopulationUnits() int {
+	if s.By == "batches" {
+		return BatchId(s.Population) + 1
+	}
+	return s.Population
+}
+
+// The number of ids in the whole population. The same with batches since ids start at 1 and the
+// last batch stops at the highest id (see UnitIds), so neither batch 0 nor the last one is full.
+func (s Sample) PopulationIds() int {
+	return s.Population
+}
+
+// Picks the units to crawl. The same seed always gives the same units.
+func (s Sample) Units() []int {
+	total := s.PopulationUnits()
+	n := int(math.Ceil(float64(total) * s.Rate))
+	if n > total {
+		n = total
+	}
+	rng := rand.New(rand.NewSource(s.Seed))
+	picked := make(map[int]bool, n)
+	units := make([]int, 0, n)
+	for len(units) < n {
+		u := rng.Intn(total)
+		if s.By != "batches" {
+			// Ids start at 1
+			u++
+		}
+		if !picked[u] {
+			picked[u] = true
+			units = append(units, u)
+		}
+	}
+	sort.Ints(units)
+	return units
+}
+
+func (s Sample) UnitIds(unit int) []int {
+	if s.By != "batches" {
+		return []int{unit}
+	}
+	ids := []int{}
+	first, last := BatchRange(unit)
+	for id := first; id <= last; id++ {
+		if id > 0 && id <= s.Population {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Returns true if the unit was already crawled by an earlier run of this sample
+func SampleDone(r redis.Conn, s Sample, unit int) bool {
+	done, _ := redis.Bool(r.Do("HEXISTS", sampleKey(s.Kind, "units"), unit))
+	return done
+}
+
+// Crawls every id in a unit and stores the sum of each metric. Only the track or playlist itself is
+// requested (no comments or favoriters) so a sample is cheap. Live results are kept in
+// sample:trackMeta / sample:playlistTracks. Only ids SoundCloud says are gone count as not live
+// (see DeadReason). Any other error leaves the unit out so the next run of the sample tries it again.
+func (c *Crawler) SampleUnit(r redis.Conn, s Sample, unit int) error {
+	sums := make([]int64, len(SampleMetrics[s.Kind]))
+	for _, id := range s.UnitIds(unit) {
+		switch s.Kind {
+		case "tracks":
+			track, err := c.GetTrack(id)
+			if err != nil {
+				if _, dead := DeadReason(err); dead {
+					continue
+				}
+				return fmt.Errorf("sample unit %d: %v", unit, err)
+			}
+			sums[0]++
+			sums[1] += int64(track.FavoritingsCount)
+			sums[2] += int64(track.CommentCount)
+			sums[3] += int64(track.PlaybackCount)
+			if j, err := json.Marshal(track); err == nil {
+				key, hkey := RedisKey(SamplePrefix+"trackMeta", id)
+				r.Do("HSET", key, hkey, string(j))
+			}
+		case "playlists":
+			playlist, err := c.GetPlaylist(id)
+			if err != nil {
+				if _, dead := DeadReason(err); dead {
+					continue
+				}
+				return fmt.Errorf("sample unit %d: %v", unit, err)
+			}
+			if len(playlist.Tracks) == 0 {
+				// Dead as far as the crawl is concerned (see store.DeadEmpty)
+				continue
+			}
+			sums[0]++
+			sums[1] += int64(len(playlist.Tracks))
+			track_ids := []string{}
+			for _, track := range playlist.Tracks {
+				track_ids = append(track_ids, strconv.Itoa(track.Id))
+			}
+			key, hkey := RedisKey(SamplePrefix+"playlistTracks", id)
+			r.Do("HSET", key, hkey, strings.Join(track_ids, ","))
+		default:
+			return fmt.Errorf("can't sample %q", s.Kind)
+		}
+	}
+	values := []string{}
+	for _, v := range sums {
+		values = append(values, strconv.FormatInt(v, 10))
+	}
+	_, err := r.Do("HSET", sampleKey(s.Kind, "units"), unit, strings.Join(values, ","))
+	return err
+}
+
+// Removes the results of an earlier sample of this kind
+func ClearSample(r redis.Conn, kind string) error {
+	if _, err := r.Do("DEL", sampleKey(kind, "config"), sampleKey(kind, "units")); err != nil {
+		return err
+	}
+	prefix := SamplePrefix + "trackMeta"
+	if kind == "playlists" {
+		prefix = SamplePrefix + "playlistTracks"
+	}
+	return scanKeys(r, Key(prefix)+":*", func(key string) error {
+		_, err := r.Do("DEL", key)
+		return err
+	})
+}
+
+// An Estimate for the whole population with a 95% confidence interval
+type Estimate struct {
+	Name  string
+	Value float64
+	Low   float64
+	High  float64
+}
+
+// Scales the sample up to the whole population. For every metric we estimate the total and for
+// everything besides "live" also the average per live entity (a ratio estimate). The share of live
+// ids comes from the "live" total.
+func SampleEstimates(r redis.Conn, s Sample) ([]Estimate, int, error) {
+	units, err := redis.StringMap(r.Do("HGETALL", sampleKey(s.Kind, "units")))
+	if err != nil {
+		return nil, 0, err
+	}
+	metrics := SampleMetrics[s.Kind]
+	rows := [][]float64{}
+	for _, v := range units {
+		parts := strings.Split(v, ",")
+		if len(parts) != len(metrics) {
+			continue
+		}
+		row := make([]float64, len(metrics))
+		for i, p := range parts {
+			row[i], _ = strconv.ParseFloat(p, 64)
+		}
+		rows = append(rows, row)
+	}
+	n := float64(len(rows))
+	if n < 2 {
+		return nil, len(rows), fmt.Errorf("need at least 2 sampled units, have %d", len(rows))
+	}
+	N := float64(s.PopulationUnits())
+	// Finite population correction since we sample without replacement
+	fpc := 1 - n/N
+	if fpc < 0 {
+		fpc = 0
+	}
+
+	means := make([]float64, len(metrics))
+	for _, row := range rows {
+		for i, v := range row {
+			means[i] += v / n
+		}
+	}
+
+	estimates := []Estimate{}
+	for i, name := range metrics {
+		variance := 0.0
+		for _, row := range rows {
+			variance += (row[i] - means[i]) * (row[i] - means[i]) / (n - 1)
+		}
+		total := N * means[i]
+		se := N * math.Sqrt(fpc*variance/n)
+		estimates = append(estimates, Estimate{"total " + name, total, total - 1.96*se, total + 1.96*se})
+		if name == "live" {
+			ids := float64(s.PopulationIds())
+			estimates = append(estimates, Estimate{"share live", total / ids, (total - 1.96*se) / ids, (total + 1.96*se) / ids})
+			continue
+		}
+		if means[0] == 0 {
+			continue
+		}
+		// Ratio estimate of the average per live entity with a linearized variance
+		ratio := means[i] / means[0]
+		variance = 0
+		for _, row := range rows {
+			d := row[i] - ratio*row[0]
+			variance += d * d / (n - 1)
+		}
+		se = math.Sqrt(fpc*variance/n) / means[0]
+		estimates = append(estimates, Estimate{"average " + name + " per live", ratio, ratio - 1.96*se, ratio + 1.96*se})
+	}
+	return estimates, len(rows), nil
+}
@@ -0,0 +1,152 @@
+package crawler
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Answers with the body stored for a path, 404 for anything else
+type fakeAPI map[string]string
+
+func (f fakeAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := 200
+	body, ok := f[req.URL.Path]
+	if !ok {
+		status, body = 404, `{}`
+	}
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Header:     http.Header{},
+		Request:    req,
+	}, nil
+}
+
+func TestSampleUnits(t *testing.T) {
+	tests := []struct {
+		s     Sample
+		units int
+		max   int
+	}{
+		{Sample{By: "ids", Rate: 0.1, Population: 95, Seed: 1}, 10, 95},
+		{Sample{By: "ids", Rate: 2, Population: 5, Seed: 1}, 5, 5},
+		{Sample{By: "batches", Rate: 0.5, Population: 3500, Seed: 7}, 2, 3},
+	}
+	for _, test := range tests {
+		units := test.s.Units()
+		if len(units) != test.units || !sort.IntsAreSorted(units) {
+			t.Errorf("%+v: got units %v, want %d sorted", test.s, units, test.units)
+		}
+		for _, u := range units {
+			if u > test.max || test.s.By == "ids" && u < 1 {
+				t.Errorf("%+v: unit %d is out of range", test.s, u)
+			}
+		}
+		if again := test.s.Units(); !reflect.DeepEqual(units, again) {
+			t.Errorf("%+v: the same seed picked %v and then %v", test.s, units, again)
+		}
+	}
+}
+
+func TestSampleUnitIds(t *testing.T) {
+	tests := []struct {
+		s     Sample
+		unit  int
+		first int
+		last  int
+	}{
+		{Sample{By: "ids", Population: 3500}, 42, 42, 42},
+		{Sample{By: "batches", Population: 3500}, 0, 1, 999},
+		{Sample{By: "batches", Population: 3500}, 1, 1000, 1999},
+		{Sample{By: "batches", Population: 3500}, 3, 3000, 3500},
+	}
+	for _, test := range tests {
+		ids := test.s.UnitIds(test.unit)
+		if len(ids) == 0 || ids[0] != test.first || ids[len(ids)-1] != test.last || len(ids) != test.last-test.first+1 {
+			t.Errorf("unit %d of %+v: got %d ids, want %d to %d", test.unit, test.s, len(ids), test.first, test.last)
+		}
+	}
+}
+
+func TestSampleUnit(t *testing.T) {
+	_, r := testRedis(t)
+	c := &Crawler{HttpClient: &http.Client{Transport: fakeAPI{
+		"/tracks/1":    `{"id":1,"favoritings_count":3,"comment_count":1,"playback_count":10}`,
+		"/tracks/2":    `{"id":2,"favoritings_count":1,"comment_count":0,"playback_count":4}`,
+		"/playlists/5": `{"id":5,"tracks":[{"id":1},{"id":2}]}`,
+		"/playlists/6": `{"id":6,"tracks":[]}`,
+	}}}
+	tests := []struct {
+		s    Sample
+		unit int
+		want string
+	}{
+		{Sample{Kind: "tracks", By: "ids", Population: 10}, 1, "1,3,1,10"},
+		// A missing track counts as not live
+		{Sample{Kind: "tracks", By: "ids", Population: 10}, 3, "0,0,0,0"},
+		{Sample{Kind: "tracks", By: "batches", Population: 10}, 0, "2,4,1,14"},
+		{Sample{Kind: "playlists", By: "ids", Population: 10}, 5, "1,2"},
+		// An empty playlist isn't live either
+		{Sample{Kind: "playlists", By: "ids", Population: 10}, 6, "0,0"},
+	}
+	for _, test := range tests {
+		if err := c.SampleUnit(r, test.s, test.unit); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := redis.String(r.Do("HGET", sampleKey(test.s.Kind, "units"), test.unit))
+		if got != test.want {
+			t.Errorf("%s unit %d by %s: got %q, want %q", test.s.Kind, test.unit, test.s.By, got, test.want)
+		}
+		if !SampleDone(r, test.s, test.unit) {
+			t.Errorf("%s unit %d isn't done", test.s.Kind, test.unit)
+		}
+	}
+	if err := ClearSample(r, "tracks"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := redis.Int(r.Do("DBSIZE")); n != 2 {
+		t.Errorf("%d keys are left after clearing the tracks, want the 2 of the playlists", n)
+	}
+}
+
+func TestSampleEstimates(t *testing.T) {
+	_, r := testRedis(t)
+	s := Sample{Kind: "playlists", By: "ids", Rate: 0.5, Population: 8}
+	// Half of the sampled ids are live with 2 tracks each
+	for unit, v := range map[int]string{1: "1,2", 2: "0,0", 3: "1,2", 4: "0,0"} {
+		r.Do("HSET", sampleKey(s.Kind, "units"), unit, v)
+	}
+	estimates, n, err := SampleEstimates(r, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("used %d units, want 4", n)
+	}
+	want := map[string]float64{
+		"total live":              4,
+		"share live":              0.5,
+		"total tracks":            8,
+		"average tracks per live": 2,
+	}
+	for _, e := range estimates {
+		if v, ok := want[e.Name]; !ok || e.Value != v || e.Low > e.Value || e.High < e.Value {
+			t.Errorf("got %+v, want %v", e, v)
+		}
+		delete(want, e.Name)
+	}
+	if len(want) > 0 {
+		t.Errorf("missing estimates %v", want)
+	}
+
+	r.Do("DEL", sampleKey(s.Kind, "units"))
+	r.Do("HSET", sampleKey(s.Kind, "units"), 1, "1,2")
+	if _, _, err := SampleEstimates(r, s); err == nil {
+		t.Errorf("estimated from a single unit")
+	}
+}
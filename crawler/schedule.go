@@ -0,0 +1,117 @@
+package crawler
+
+import (
+	"github.com/Abramovic/soundclouder/config"
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// In continuous mode every batch of tracks and playlists lives in a sorted set where the score
+// is the unix timestamp of when the batch is due to be crawled again.
+const (
+	TrackSchedule    = "crawlScheduleTracks"
+	PlaylistSchedule = "crawlSchedulePlaylists"
+	TrackFrontier    = "trackFrontier"
+	PlaylistFrontier = "playlistFrontier"
+)
+
+// Each entity keeps the unix timestamp of its last crawl and when it is due next.
+// The prefix is the entity type ("track" or "playlist").
+func LastCrawlKey(prefix string, id int) (string, string) {
+	return RedisKey(prefix+"LastCrawl", id)
+}
+
+func NextCrawlKey(prefix string, id int) (string, string) {
+	return RedisKey(prefix+"NextCrawl", id)
+}
+
+// Returns true if the entity has never been crawled or if its next crawl time has passed.
+func IsDue(g store.GraphStore, kind string, id int, now time.Time) bool {
+	next, ok, err := g.NextCrawl(kind, id)
+	if err != nil || !ok {
+		return true
+	}
+	return !next.After(now)
+}
+
+// Stores the time of this crawl and schedules the next one depending on the tier of the entity.
+// An entity below every tier (only possible when none of them has a min_edges of 0) is crawled
+// again on the default interval.
+func (c *Crawler) MarkCrawled(g store.GraphStore, kind string, id, edges int, now time.Time) time.Time {
+	tier, ok := c.Config.Tier(edges)
+	if !ok {
+		tier = config.DefaultRecrawlTiers[0]
+	}
+	next := now.Add(tier.Duration())
+	g.MarkCrawled(kind, id, now, next)
+	return next
+}
+
+// Puts the batch back onto the schedule using the earliest next crawl time of the entities inside of it.
+// A batch without any (every request failed, or it's all dead ids that are never checked again)
+// is tried again after retry so it doesn't fall off the schedule for good.
+func ScheduleNextBatch(r redis.Conn, g store.GraphStore, schedule, kind string, batch_id int, retry time.Duration) error {
+	first, last := BatchRange(batch_id)
+	due, ok, err := g.EarliestNextCrawl(kind, first, last)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		due = time.Now().Add(retry)
+	}
+	return ScheduleBatch(r, schedule, batch_id, due)
+}
+
+func ScheduleBatch(r redis.Conn, schedule string, batch_id int, due time.Time) error {
+	_, err := r.Do("ZADD", Key(schedule), due.Unix(), batch_id)
+	return err
+}
+
+// Claims up to limit batches that are due. A batch is only returned to the worker that removed it
+// from the schedule so multiple workers will never crawl the same batch at once.
+func DueBatches(r redis.Conn, schedule string, now time.Time, limit int) ([]int, error) {
+	ids, err := redis.Ints(r.Do("ZRANGEBYSCORE", Key(schedule), "-inf", now.Unix(), "LIMIT", 0, limit))
+	if err != nil {
+		return nil, err
+	}
+	batches := []int{}
+	for _, id := range ids {
+		removed, err := redis.Int(r.Do("ZREM", Key(schedule), id))
+		if err == nil && removed == 1 {
+			batches = append(batches, id)
+		}
+	}
+	return batches, nil
+}
+
+// Seeds every id above the frontier up to max_id as pending and schedules the new batches
+// to be crawled right away. Returns the new frontier.
+func AdvanceFrontier(r redis.Conn, g store.GraphStore, frontierKey, kind, schedule string, max_id int, now time.Time) (int, error) {
+	frontier, err := redis.Int(r.Do("GET", Key(frontierKey)))
+	if err != nil && err != redis.ErrNil {
+		return 0, err
+	}
+	if max_id <= frontier {
+		return frontier, nil
+	}
+	for batch_id := BatchId(frontier); batch_id <= BatchId(max_id); batch_id++ {
+		ids := []int{}
+		first, last := BatchRange(batch_id)
+		for id := first; id <= last; id++ {
+			if id <= frontier || id > max_id {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		if _, err := g.AddPending(kind, ids); err != nil {
+			return frontier, err
+		}
+		ScheduleBatch(r, schedule, batch_id, now)
+	}
+	_, err = r.Do("SET", Key(frontierKey), max_id)
+	return max_id, err
+}
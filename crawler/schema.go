@@ -0,0 +1,192 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+)
+
+// Which version of the key layout a namespace is in. A crawl that was started before there were
+// versions doesn't have the key and is version 1.
+const SchemaVersionKey = "schemaVersion"
+
+// How far a running migration got: "<version>:<hash>" -> the SCAN cursor to go on from, or "done"
+const schemaProgress = "schemaMigration"
+
+// A Migration moves the layout from Version-1 to Version. It goes through every <hash>:<batch>
+// hash of each of Hashes with SCAN and calls Step on them one at a time.
+type Migration struct {
+	Version int
+	Name    string
+	Hashes  []string
+	// Step has to be safe to run twice on the same hash, since an interrupted migration starts
+	// again at the last SCAN page it finished.
+	Step func(r redis.Conn, key string) error
+}
+
+// Every change to the layout, oldest first. Add new ones at the end with the next version.
+var Migrations = []Migration{
+	{
+		Version: 2,
+		Name:    "remove duplicate favoriters and commenters",
+		Hashes:  []string{store.TrackFavoriters, store.TrackCommenters},
+		Step:    dedupeEdges,
+	},
+	{
+		// Nothing to rewrite, but a worker from before this would still HDEL dead ids
+		Version: 3,
+		Name:    "tombstones instead of deleting dead ids",
+	},
+	{
+		Version: 4,
+		Name:    "crawl state in bitmaps",
+		Hashes:  []string{stateHashes[store.Tracks], stateHashes[store.Playlists]},
+		Step:    stateBitmaps,
+	},
+}
+
+var ErrSchemaTooNew = errors.New("this crawl was written by a newer soundclouder, update before crawling it")
+
+// The version a new crawl starts at
+func LatestSchema() int {
+	if len(Migrations) == 0 {
+		return 1
+	}
+	return Migrations[len(Migrations)-1].Version
+}
+
+func SchemaVersion(r redis.Conn) (int, error) {
+	version, err := redis.Int(r.Do("GET", Key(SchemaVersionKey)))
+	if err == redis.ErrNil {
+		return 1, nil
+	}
+	return version, err
+}
+
+// The migrations that still have to run on this crawl
+func PendingMigrations(r redis.Conn) ([]Migration, error) {
+	version, err := SchemaVersion(r)
+	if err != nil {
+		return nil, err
+	}
+	if version > LatestSchema() {
+		return nil, ErrSchemaTooNew
+	}
+	pending := []Migration{}
+	for _, m := range Migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Runs every pending migration in order. The version is only moved on once a migration went
+// through every hash, and the SCAN cursor is saved after every page, so a migration that was
+// interrupted picks up close to where it stopped.
+func Migrate(r redis.Conn, progress func(m Migration, hash string, keys int)) error {
+	pending, err := PendingMigrations(r)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		for _, hash := range m.Hashes {
+			field := fmt.Sprintf("%d:%s", m.Version, hash)
+			cursor, err := redis.String(r.Do("HGET", Key(schemaProgress), field))
+			if err == redis.ErrNil {
+				cursor = "0"
+			} else if err != nil {
+				return err
+			}
+			if cursor == "done" {
+				continue
+			}
+			keys := 0
+			for {
+				reply, err := redis.Values(r.Do("SCAN", cursor, "MATCH", Key(hash)+":*", "COUNT", 1000))
+				if err != nil {
+					return err
+				}
+				cursor, _ = redis.String(reply[0], nil)
+				page, _ := redis.Strings(reply[1], nil)
+				for _, key := range page {
+					if err := m.Step(r, key); err != nil {
+						return fmt.Errorf("%s (%s): %v", m.Name, key, err)
+					}
+				}
+				keys += len(page)
+				if cursor == "0" {
+					break
+				}
+				if _, err := r.Do("HSET", Key(schemaProgress), field, cursor); err != nil {
+					return err
+				}
+			}
+			if _, err := r.Do("HSET", Key(schemaProgress), field, "done"); err != nil {
+				return err
+			}
+			progress(m, hash, keys)
+		}
+		if _, err := r.Do("SET", Key(SchemaVersionKey), m.Version); err != nil {
+			return err
+		}
+		if _, err := r.Do("DEL", Key(schemaProgress)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The first workers added every favoriter of a track to the list even if they showed up twice,
+// and counted every one of them. The list is stored again with every id only once, in the format
+// it is already in, and its counter is set to the length of that list.
+func dedupeEdges(r redis.Conn, key string) error {
+	lists, err := redis.StringMap(r.Do("HGETALL", key))
+	if err != nil {
+		return err
+	}
+	// <edge>:<batch> -> <counter>:<batch>
+	i := strings.LastIndex(key, ":")
+	edge := strings.TrimPrefix(key[:i], KeyPrefix)
+	counter, _ := store.EdgeCounter(edge)
+	counterKey := Key(counter) + key[i:]
+	for field, v := range lists {
+		if v == "null" {
+			continue
+		}
+		old := []byte(v)
+		ids, err := store.DecodeEdges(old)
+		if err != nil {
+			continue
+		}
+		unique, _ := store.EdgeDiff(nil, ids)
+		if len(unique) < len(ids) {
+			value, err := store.EncodeEdges(edge, unique, store.EdgeFormat(old))
+			if err != nil {
+				return err
+			}
+			swapped, err := redis.Int(swapScript.Do(r, key, field, sha1hex(old), value))
+			if err != nil {
+				return err
+			}
+			if swapped == 0 {
+				// Somebody stored the list in the meantime and counted it
+				continue
+			}
+		}
+		if len(unique) == 0 {
+			r.Send("HDEL", counterKey, field)
+		} else {
+			r.Send("HSET", counterKey, field, len(unique))
+		}
+	}
+	return flushSent(r)
+}
+
+// Marks a crawl that was just started as being on the latest layout
+func initSchema(r redis.Conn) error {
+	_, err := r.Do("SET", Key(SchemaVersionKey), LatestSchema(), "NX")
+	return err
+}
@@ -0,0 +1,46 @@
+package crawler
+
+import (
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+func TestDedupeMigrationRecountsEdges(t *testing.T) {
+	_, r := testRedis(t)
+	// A crawl from before there were versions
+	r.Send("HSET", "trackFavoriters:0", 1, "7,8,7,8,9", 2, "7", 3, "")
+	r.Send("HSET", "trackCountFavoriters:0", 1, 5, 2, 1, 3, 2)
+	r.Send("HSET", "trackCommenters:0", 1, "7,7")
+	r.Send("HSET", "trackCountCommenters:0", 1, 2)
+	if err := flushSent(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(r, func(Migration, string, int) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key   string
+		field int
+		list  string
+		count int
+	}{
+		{"trackFavoriters:0", 1, "7,8,9", 3},
+		{"trackFavoriters:0", 2, "7", 1},
+		{"trackFavoriters:0", 3, "", 0},
+		{"trackCommenters:0", 1, "7", 1},
+	}
+	for _, test := range tests {
+		list, err := redis.String(r.Do("HGET", test.key, test.field))
+		if err != nil || list != test.list {
+			t.Errorf("%s %d is %q (%v), want %q", test.key, test.field, list, err, test.list)
+		}
+		edge := test.key[:len(test.key)-2]
+		counter, _ := store.EdgeCounter(edge)
+		count, _ := redis.Int(r.Do("HGET", counter+":0", test.field))
+		if count != test.count {
+			t.Errorf("%s %d is %d, want %d", counter, test.field, count, test.count)
+		}
+	}
+}
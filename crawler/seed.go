@@ -0,0 +1,181 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"time"
+)
+
+const (
+	SeedLock   = "seedLock"
+	SeedMarker = "seeded"
+	// How long a worker holds on to the seeding lock before it has to renew it
+	seedLockTTL = 10 * 60
+)
+
+var (
+	ErrAlreadySeeded = errors.New("this crawl has already been seeded (use -force=true to seed it again)")
+	ErrSeedLocked    = errors.New("another worker is seeding this crawl right now")
+	ErrLostSeedLock  = errors.New("lost the seeding lock to another worker")
+)
+
+// Sets the known bit (ARGV are the offsets in the batch) of every id and returns how many of them
+// we didn't know about yet. Nothing else is touched so seeding never undoes a crawl.
+var fillScript = redis.NewScript(1, `
+local added = 0
+for i = 1, #ARGV do
+	added = added + 1 - redis.call("SETBIT", KEYS[1], ARGV[i], 1)
+end
+return added
+`)
+
+// Lock helpers only touch the lock if we are still the owner.
+var releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+var renewScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("EXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+type seedLock struct {
+	r     redis.Conn
+	token string
+}
+
+func lockSeeding(r redis.Conn) (*seedLock, error) {
+	host, _ := os.Hostname()
+	token := fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+	_, err := redis.String(r.Do("SET", Key(SeedLock), token, "NX", "EX", seedLockTTL))
+	if err == redis.ErrNil {
+		return nil, ErrSeedLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &seedLock{r: r, token: token}, nil
+}
+
+func (l *seedLock) renew() error {
+	ok, err := redis.Int(renewScript.Do(l.r, Key(SeedLock), l.token, seedLockTTL))
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrLostSeedLock
+	}
+	return nil
+}
+
+func (l *seedLock) release() {
+	releaseScript.Do(l.r, Key(SeedLock), l.token)
+}
+
+// Seed marks every track up to max_track and every playlist up to max_playlist that we haven't seen
+// yet as pending and queues up all of the batches. Only one worker can seed at a time and
+// a crawl that was already seeded is left alone unless force is true.
+func (c *Crawler) Seed(max_track, max_playlist int, force bool) error {
+	if c.Local != nil {
+		return c.seedLocal(max_track, max_playlist, force)
+	}
+	r := c.RedisClient.Get()
+	defer r.Close()
+
+	lock, err := lockSeeding(r)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	generation, err := redis.Int(r.Do("HGET", Key(SeedMarker), "generation"))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if generation > 0 && !force {
+		return ErrAlreadySeeded
+	}
+
+	g := c.Graph()
+	defer g.Close()
+	if err := seedBatches(r, g, lock, store.Tracks, c.TrackQueue, Selector{}, max_track); err != nil {
+		return err
+	}
+	// The continuous crawler will only look for new tracks and playlists above these ids
+	_, last := BatchRange(BatchId(max_track) + 1)
+	r.Do("SET", Key(TrackFrontier), last)
+	if err := seedBatches(r, g, lock, store.Playlists, c.PlaylistQueue, Selector{}, max_playlist); err != nil {
+		return err
+	}
+	_, last = BatchRange(BatchId(max_playlist) + 1)
+	r.Do("SET", Key(PlaylistFrontier), last)
+
+	// Only mark the crawl as seeded once everything is in Redis. If we die halfway through
+	// the next worker will pick up the lock and fill in whatever is still missing.
+	_, err = r.Do("HMSET", Key(SeedMarker),
+		"generation", generation+1,
+		"tracks", max_track,
+		"playlists", max_playlist,
+		"at", time.Now().Unix(),
+	)
+	return err
+}
+
+// SeedSelection seeds and queues only the ids picked by the selector. It doesn't care if the crawl
+// was seeded before (we only fill in what is missing anyway) and it doesn't mark the crawl as seeded.
+func (c *Crawler) SeedSelection(kind string, queue Queue, sel Selector, max_id int) error {
+	if c.Local != nil {
+		return seedBatches(nil, c.Local, nil, kind, queue, sel, max_id)
+	}
+	r := c.RedisClient.Get()
+	defer r.Close()
+
+	lock, err := lockSeeding(r)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	g := c.Graph()
+	defer g.Close()
+	return seedBatches(r, g, lock, kind, queue, sel, max_id)
+}
+
+func seedBatches(r redis.Conn, g store.GraphStore, lock *seedLock, kind string, queue Queue, sel Selector, max_id int) error {
+	batch_max := BatchId(max_id) + 1
+	if sel.To > 0 && BatchId(sel.To) < batch_max {
+		batch_max = BatchId(sel.To)
+	}
+	for i := batch_max; i > 0; i-- {
+		// A crawl without Redis doesn't need a lock
+		if lock != nil && i%1000 == 0 {
+			if err := lock.renew(); err != nil {
+				return err
+			}
+		}
+		if !sel.HasBatch(i) {
+			continue
+		}
+		ids := []int{}
+		first, last := BatchRange(i)
+		for id := last; id >= first; id-- {
+			if sel.HasId(id) {
+				ids = append(ids, id)
+			}
+		}
+		if _, err := g.AddPending(kind, ids); err != nil {
+			return err
+		}
+		if err := queue.Push(r, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
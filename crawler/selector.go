@@ -0,0 +1,69 @@
+package crawler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Selector picks part of the id space to seed and crawl. From and To are an inclusive id range
+// (To of 0 means no upper bound) and Shard/Shards splits the batches into Shards groups by batch id.
+// The zero value selects everything.
+type Selector struct {
+	From   int
+	To     int
+	Shard  int
+	Shards int
+}
+
+// Parses "i/n" where i goes from 0 to n-1
+func ParseShard(s string) (int, int, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected i/n", s)
+	}
+	i, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected i/n", s)
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n < 1 || i < 0 || i >= n {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected i/n with 0 <= i < n", s)
+	}
+	return i, n, nil
+}
+
+func (s Selector) IsSet() bool {
+	return s.From > 0 || s.To > 0 || s.Shards > 1
+}
+
+// Used to name the queues of a selection so it doesn't touch the regular queues
+func (s Selector) String() string {
+	parts := []string{}
+	if s.From > 0 || s.To > 0 {
+		parts = append(parts, fmt.Sprintf("%d-%d", s.From, s.To))
+	}
+	if s.Shards > 1 {
+		parts = append(parts, fmt.Sprintf("shard%dof%d", s.Shard, s.Shards))
+	}
+	return strings.Join(parts, ":")
+}
+
+func (s Selector) HasId(id int) bool {
+	if id < s.From || (s.To > 0 && id > s.To) {
+		return false
+	}
+	return s.HasBatch(BatchId(id))
+}
+
+// True if any id in the batch is selected
+func (s Selector) HasBatch(batch_id int) bool {
+	first, last := BatchRange(batch_id)
+	if last < s.From || (s.To > 0 && first > s.To) {
+		return false
+	}
+	if s.Shards > 1 && batch_id%s.Shards != s.Shard {
+		return false
+	}
+	return true
+}
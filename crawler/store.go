@@ -0,0 +1,507 @@
+package crawler
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/Abramovic/soundclouder/models"
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"time"
+)
+
+// The hash that holds the crawled data of a kind. Only ids we got something for are in it, whether
+// an id is pending, live or dead is in the state bitmaps (see crawlstate.go). Dead ids keep what
+// they had and have a field in the <prefix>Tombstones hash.
+var stateHashes = map[string]string{
+	store.Tracks:    "trackMeta",
+	store.Playlists: "playlistTracks",
+}
+
+// The prefix of the LastCrawl, NextCrawl and Tombstones hashes of a kind
+var crawlPrefixes = map[string]string{
+	store.Tracks:    "track",
+	store.Playlists: "playlist",
+}
+
+// RedisStore is the original layout: one Redis hash per batch for every kind of data. It holds on
+// to one connection from the pool until it is closed.
+//
+// Writes don't wait for Redis. They are queued up on the connection and sent in one go once
+// Pipeline of them are waiting, when we need to read something or when Flush is called. This saves
+// a round trip for almost every write which is what slows down a worker talking to a remote Redis.
+// That includes users and the edge script, whose replies are only checked once they are back. The
+// known bitmap IsPending needs is read once per batch.
+type RedisStore struct {
+	// How many writes are queued up before they are sent. 1 sends every write on its own.
+	Pipeline int
+	// How edge lists are written (store.EdgesCSV if empty). Lists in any format can be read.
+	EdgeFormat string
+	// How tracks and users are written (store.ModelsJSON if empty)
+	ModelFormat string
+	r           redis.Conn
+	prefix      string
+	// What to check in the reply of every queued write, nil if it only has to succeed
+	checks []func(reply interface{}) error
+	loaded bool
+	// The known bitmap of the batch IsPending was last asked about. Known bits are never cleared
+	// so it's kept until the next Flush, which a worker calls at the end of every batch.
+	knownKey  string
+	knownBits []byte
+	// The first write that failed since the last Flush
+	err error
+}
+
+// Replaces an edge list and moves its counter by the difference to the old list in one step, so
+// two workers (or a batch that was handed out twice) can't both count the same edges. The diff is
+// made in Go since Lua can't read the binary formats, so the script only goes ahead if the list is
+// still the one the diff was made against and returns 0 otherwise.
+//
+// KEYS[1] is the hash with the edge list. ARGV[1] is the id, ARGV[2] the SHA1 of the list the diff
+// was made against, ARGV[3] the new list and ARGV[5] how many ids were added. With ARGV[4] "id" the
+// counter belongs to the id itself, KEYS[2] is its hash and ARGV[6] how many ids were removed. With
+// "members" every member of the list has its own counter (that's how a track knows how many
+// playlists it is in): the added ids and then the removed ones follow from ARGV[6] on, each with
+// its counter hash in KEYS, starting at KEYS[2]. Every key is passed in KEYS so Redis Cluster knows
+// where the script has to run.
+var edgeScript = redis.NewScript(-1, `
+local old = redis.call("HGET", KEYS[1], ARGV[1]) or ""
+if redis.sha1hex(old) ~= ARGV[2] then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+local added = tonumber(ARGV[5])
+if ARGV[4] == "id" then
+	local removed = tonumber(ARGV[6])
+	if added ~= removed then
+		redis.call("HINCRBY", KEYS[2], ARGV[1], added - removed)
+	end
+else
+	for i = 6, #ARGV do
+		local by = 1
+		if i > 5 + added then by = -1 end
+		redis.call("HINCRBY", KEYS[i - 4], ARGV[i], by)
+	end
+end
+return 1
+`)
+
+// Swaps one stored value for another unless it changed in the meantime. ARGV[2] is the SHA1 of
+// the value we expect to find.
+var swapScript = redis.NewScript(1, `
+local old = redis.call("HGET", KEYS[1], ARGV[1]) or ""
+if redis.sha1hex(old) ~= ARGV[2] then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+return 1
+`)
+
+var storeScripts = []*redis.Script{fillScript, edgeScript, swapScript}
+
+func NewRedisStore(r redis.Conn, pipeline int) *RedisStore {
+	return &RedisStore{r: r, Pipeline: pipeline}
+}
+
+func (s *RedisStore) key(name string, id int) (string, string) {
+	return RedisKey(s.prefix+name, id)
+}
+
+// Queues a write
+func (s *RedisStore) send(cmd string, args ...interface{}) error {
+	return s.queue(nil, cmd, args...)
+}
+
+// Queues a write whose reply is handed to check once it's back. An error from check counts as a
+// failed write.
+func (s *RedisStore) queue(check func(reply interface{}) error, cmd string, args ...interface{}) error {
+	if s.Pipeline <= 1 {
+		reply, err := s.r.Do(cmd, args...)
+		if err == nil && check != nil {
+			err = check(reply)
+		}
+		s.fail(err)
+		return err
+	}
+	if err := s.r.Send(cmd, args...); err != nil {
+		return err
+	}
+	s.checks = append(s.checks, check)
+	if len(s.checks) >= s.Pipeline {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Queues one of our scripts. Only the hash goes over the wire, so the scripts are loaded first.
+func (s *RedisStore) queueScript(check func(reply interface{}) error, script *redis.Script, keysAndArgs ...interface{}) error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	return s.queue(check, "EVALSHA", append([]interface{}{script.Hash()}, keysAndArgs...)...)
+}
+
+// Reads have to wait for Redis. The queued writes go out first and their errors are kept for
+// Flush, so a read only fails because of the read itself.
+func (s *RedisStore) do(cmd string, args ...interface{}) (interface{}, error) {
+	s.drain()
+	return s.r.Do(cmd, args...)
+}
+
+// Runs one of our scripts. They are loaded the first time a connection needs one so after that
+// only the hash goes over the wire.
+func (s *RedisStore) eval(script *redis.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	s.drain()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return script.Do(s.r, keysAndArgs...)
+}
+
+func (s *RedisStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	s.drain()
+	for _, script := range storeScripts {
+		if err := script.Load(s.r); err != nil {
+			return err
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+// Sends every queued write and waits for all of the replies
+func (s *RedisStore) drain() {
+	if len(s.checks) == 0 {
+		return
+	}
+	checks := s.checks
+	s.checks = nil
+	if err := s.r.Flush(); err != nil {
+		s.fail(err)
+		return
+	}
+	for _, check := range checks {
+		reply, err := s.r.Receive()
+		if err, ok := err.(redis.Error); ok && strings.HasPrefix(string(err), "NOSCRIPT") {
+			// Redis lost our scripts (a restart or SCRIPT FLUSH), load them again next time
+			s.loaded = false
+		}
+		if err == nil && check != nil {
+			err = check(reply)
+		}
+		s.fail(err)
+	}
+}
+
+func (s *RedisStore) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Waits until Redis has every queued write and returns the first write that failed since the last
+// Flush, whether it failed here or came back while a read was waiting.
+func (s *RedisStore) Flush() error {
+	s.drain()
+	s.knownKey, s.knownBits = "", nil
+	err := s.err
+	s.err = nil
+	return err
+}
+
+// Gives a worker its own GraphStore. A graph in a local file is shared by every worker.
+func (c *Crawler) Graph() store.GraphStore {
+	if c.graph != nil {
+		return c.graph
+	}
+	s := NewRedisStore(c.RedisClient.Get(), c.Config.PipelineSize())
+	s.EdgeFormat = c.Config.EdgeFormat
+	s.ModelFormat = c.Config.ModelFormat
+	return s
+}
+
+// Every worker stores the graph in g instead of Redis from now on. Tests use it to hand the
+// workers a MemoryStore.
+func (c *Crawler) UseGraph(g store.SharedStore) {
+	c.graph = g
+}
+
+// Opens the file the graph is stored in. Does nothing when the graph is kept in Redis.
+// "sqlite" only moves the graph, the queues and everything else stay in Redis.
+func (c *Crawler) OpenStore() error {
+	if err := store.ValidEdgeFormat(c.Config.EdgeFormat); err != nil {
+		return err
+	}
+	if err := store.ValidModelFormat(c.Config.ModelFormat); err != nil {
+		return err
+	}
+	switch c.Config.Storage {
+	case "", "redis":
+		return nil
+	case "bolt":
+		b, err := store.OpenBolt(c.Config.Path())
+		if err != nil {
+			return fmt.Errorf("can't open %s: %v", c.Config.Path(), err)
+		}
+		c.Local, c.graph = b, b
+		return nil
+	case "sqlite":
+		s, err := store.OpenSQLite(c.Config.Path())
+		if err != nil {
+			return fmt.Errorf("can't open %s: %v", c.Config.Path(), err)
+		}
+		c.graph = s
+		return nil
+	}
+	return fmt.Errorf("unknown storage %q", c.Config.Storage)
+}
+
+func (s *RedisStore) AddPending(kind string, ids []int) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	// Every id has to be in the same batch since they all go into one bitmap
+	key, _ := s.bit(kind, stateKnown, ids[0])
+	args := []interface{}{key}
+	for _, id := range ids {
+		args = append(args, id%BatchSize)
+		s.setKnown(kind, id)
+	}
+	return redis.Int(s.eval(fillScript, args...))
+}
+
+func (s *RedisStore) Ids(kind string, first, last int) ([]int, error) {
+	key, _ := s.bit(kind, stateKnown, first)
+	bits, err := redis.Bytes(s.do("GET", key))
+	if err == redis.ErrNil {
+		return []int{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	batch := BatchId(first) * BatchSize
+	ids := []int{}
+	for _, offset := range setBits(bits) {
+		if id := batch + offset; id >= first && id <= last {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *RedisStore) IsPending(kind string, id int) (bool, error) {
+	key, offset := s.bit(kind, stateKnown, id)
+	if key != s.knownKey {
+		bits, err := redis.Bytes(s.do("GET", key))
+		if err != nil && err != redis.ErrNil {
+			return false, err
+		}
+		s.knownKey, s.knownBits = key, bits
+	}
+	return bitSet(s.knownBits, offset), nil
+}
+
+func (s *RedisStore) MarkDead(kind string, id int, reason string, at time.Time) (store.Tombstone, error) {
+	key, hkey := s.key(stateHashes[kind], id)
+	crawled, err := redis.Bool(s.do("HEXISTS", key, hkey))
+	if err != nil {
+		return store.Tombstone{}, err
+	}
+	old, buried, err := s.Tombstone(kind, id)
+	if err != nil {
+		return store.Tombstone{}, err
+	}
+	t := store.Bury(old, buried, reason, crawled, at)
+	for _, b := range []struct {
+		state string
+		value int
+	}{{stateKnown, 1}, {stateLive, 0}, {stateDead, 1}} {
+		key, offset := s.bit(kind, b.state, id)
+		if err := s.send("SETBIT", key, offset, b.value); err != nil {
+			return store.Tombstone{}, err
+		}
+	}
+	s.setKnown(kind, id)
+	// Most of the id space was never used. Those ids only get the dead bit, unless they're
+	// checked again and there's a count to keep.
+	if t.Reason != store.DeadMissing || t.Checks > 1 {
+		key, hkey = s.key(crawlPrefixes[kind]+"Tombstones", id)
+		if err := s.send("HSET", key, hkey, t.String()); err != nil {
+			return store.Tombstone{}, err
+		}
+	}
+	key, hkey = s.key(crawlPrefixes[kind]+"NextCrawl", id)
+	return t, s.send("HDEL", key, hkey)
+}
+
+// A dead id without a tombstone in the hash was missing the one time we checked it. When that was
+// is in LastCrawl if its reason gets rechecked, otherwise we don't know.
+func (s *RedisStore) Tombstone(kind string, id int) (store.Tombstone, bool, error) {
+	key, offset := s.bit(kind, stateDead, id)
+	dead, err := redis.Bool(s.do("GETBIT", key, offset))
+	if err != nil || !dead {
+		return store.Tombstone{}, false, err
+	}
+	key, hkey := s.key(crawlPrefixes[kind]+"Tombstones", id)
+	v, err := redis.String(s.do("HGET", key, hkey))
+	if err == redis.ErrNil {
+		t := store.Tombstone{Reason: store.DeadMissing, Checks: 1}
+		key, hkey = s.key(crawlPrefixes[kind]+"LastCrawl", id)
+		if last, err := redis.Int64(s.do("HGET", key, hkey)); err == nil {
+			t.Since = time.Unix(last, 0)
+			t.Checked = t.Since
+		}
+		return t, true, nil
+	}
+	if err != nil {
+		return store.Tombstone{}, false, err
+	}
+	t, err := store.ParseTombstone(v)
+	return t, err == nil, err
+}
+
+func (s *RedisStore) PutTrack(track *models.Track) error {
+	v, err := store.EncodeModel(track, s.ModelFormat)
+	if err != nil {
+		return err
+	}
+	key, hkey := s.key(stateHashes[store.Tracks], track.Id)
+	if err := s.send("HSET", key, hkey, v); err != nil {
+		return err
+	}
+	return s.markLive(store.Tracks, track.Id)
+}
+
+// Nothing ever stores a "null" user so HSETNX is enough to only keep the first one. The write is
+// queued, so whether the user was new isn't known yet and it always returns false.
+func (s *RedisStore) PutUser(user models.UserPreview) (bool, error) {
+	v, err := store.EncodeModel(user, s.ModelFormat)
+	if err != nil {
+		return false, err
+	}
+	key, hkey := s.key("userMeta", user.Id)
+	return false, s.send("HSETNX", key, hkey, v)
+}
+
+// The old list is read to make the diff, the script that swaps it in is queued. If another write
+// got to the list in between, the script leaves it alone and the next Flush fails, so the batch
+// isn't acked and is crawled again.
+func (s *RedisStore) PutEdges(edge string, id int, ids []int) (int, int, error) {
+	key, hkey := s.key(edge, id)
+	value, err := store.EncodeEdges(edge, ids, s.EdgeFormat)
+	if err != nil {
+		return 0, 0, err
+	}
+	counter, perMember := store.EdgeCounter(edge)
+	old, err := redis.Bytes(s.do("HGET", key, hkey))
+	if err != nil && err != redis.ErrNil {
+		return 0, 0, err
+	}
+	before, err := store.DecodeEdges(old)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s %d: %v", edge, id, err)
+	}
+	added, removed := store.EdgeDiff(before, ids)
+	var args []interface{}
+	if perMember {
+		members := append(added, removed...)
+		args = []interface{}{1 + len(members), key}
+		for _, member := range members {
+			counterKey, _ := s.key(counter, member)
+			args = append(args, counterKey)
+		}
+		args = append(args, hkey, sha1hex(old), value, "members", len(added))
+		for _, member := range members {
+			args = append(args, member)
+		}
+	} else {
+		counterKey, _ := s.key(counter, id)
+		args = []interface{}{2, key, counterKey, hkey, sha1hex(old), value, "id", len(added), len(removed)}
+	}
+	swapped := func(reply interface{}) error {
+		if n, err := redis.Int(reply, nil); err != nil || n != 1 {
+			return fmt.Errorf("%s %d changed while it was being stored", edge, id)
+		}
+		return nil
+	}
+	if err := s.queueScript(swapped, edgeScript, args...); err != nil {
+		return 0, 0, err
+	}
+	if edge == stateHashes[store.Playlists] {
+		err = s.markLive(store.Playlists, id)
+	}
+	return len(added), len(removed), err
+}
+
+func sha1hex(v []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(v))
+}
+
+func (s *RedisStore) IncrementCounter(counter string, id, by int) error {
+	key, hkey := s.key(counter, id)
+	return s.send("HINCRBY", key, hkey, by)
+}
+
+func (s *RedisStore) CountEdges(edge string, id, by int) error {
+	key, hkey := s.key(edge, id)
+	v, err := redis.Bytes(s.do("HGET", key, hkey))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ids, err := store.DecodeEdges(v)
+	if err != nil {
+		return fmt.Errorf("%s %d: %v", edge, id, err)
+	}
+	return store.CountEdgeList(edge, id, ids, by, s.IncrementCounter)
+}
+
+func (s *RedisStore) MarkCrawled(kind string, id int, at, next time.Time) error {
+	key, hkey := s.key(crawlPrefixes[kind]+"LastCrawl", id)
+	if err := s.send("HSET", key, hkey, at.Unix()); err != nil {
+		return err
+	}
+	key, hkey = s.key(crawlPrefixes[kind]+"NextCrawl", id)
+	return s.send("HSET", key, hkey, next.Unix())
+}
+
+func (s *RedisStore) NextCrawl(kind string, id int) (time.Time, bool, error) {
+	key, hkey := s.key(crawlPrefixes[kind]+"NextCrawl", id)
+	next, err := redis.Int64(s.do("HGET", key, hkey))
+	if err == redis.ErrNil {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(next, 0), true, nil
+}
+
+func (s *RedisStore) EarliestNextCrawl(kind string, first, last int) (time.Time, bool, error) {
+	key, _ := s.key(crawlPrefixes[kind]+"NextCrawl", first)
+	times, err := redis.Int64s(s.do("HVALS", key))
+	if err != nil || len(times) == 0 {
+		return time.Time{}, false, err
+	}
+	due := times[0]
+	for _, t := range times {
+		if t < due {
+			due = t
+		}
+	}
+	return time.Unix(due, 0), true, nil
+}
+
+// Sends whatever is still queued and hands the connection back to the pool
+func (s *RedisStore) Close() error {
+	err := s.Flush()
+	if cerr := s.r.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
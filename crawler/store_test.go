@@ -0,0 +1,78 @@
+package crawler
+
+import (
+	"github.com/Abramovic/soundclouder/models"
+	"github.com/Abramovic/soundclouder/store"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"testing"
+)
+
+func TestRedisStorePipeline(t *testing.T) {
+	for _, pipeline := range []int{1, 100} {
+		_, r := testRedis(t)
+		s := NewRedisStore(r, pipeline)
+
+		s.AddPending(store.Tracks, []int{1})
+		for id, want := range map[int]bool{1: true, 2: false} {
+			if pending, err := s.IsPending(store.Tracks, id); pending != want || err != nil {
+				t.Errorf("pipeline %d: track %d pending %v (%v), want %v", pipeline, id, pending, err, want)
+			}
+		}
+		s.PutTrack(&models.Track{Id: 2})
+		if pending, _ := s.IsPending(store.Tracks, 2); !pending {
+			t.Errorf("pipeline %d: track 2 isn't pending after it was stored", pipeline)
+		}
+
+		s.PutUser(models.UserPreview{Id: 7, Permalink: "first"})
+		s.PutUser(models.UserPreview{Id: 7, Permalink: "second"})
+		s.PutEdges(store.TrackFavoriters, 1, []int{7, 8})
+		s.PutEdges(store.TrackFavoriters, 1, []int{8, 9, 10})
+		if err := s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		v, _ := redis.Bytes(r.Do("HGET", Key("userMeta:0"), 7))
+		var user models.UserPreview
+		if err := store.DecodeModel(v, &user); err != nil || user.Permalink != "first" {
+			t.Errorf("pipeline %d: stored user %+v (%v), want the first one", pipeline, user, err)
+		}
+		if n, _ := redis.Int(r.Do("HGET", Key(store.TrackCountFavoriters+":0"), 1)); n != 3 {
+			t.Errorf("pipeline %d: track 1 has %d favoriters, want 3", pipeline, n)
+		}
+
+		// Every track has its own counter, in the hash of its own batch
+		s.PutEdges(store.PlaylistTracks, 5, []int{1, 2, 1500})
+		s.PutEdges(store.PlaylistTracks, 5, []int{2, 1500, 3})
+		if err := s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		for id, want := range map[int]int{1: 0, 2: 1, 3: 1, 1500: 1} {
+			key, hkey := RedisKey(store.TrackCountPlaylist, id)
+			if n, _ := redis.Int(r.Do("HGET", key, hkey)); n != want {
+				t.Errorf("pipeline %d: track %d is in %d playlists, want %d", pipeline, id, n, want)
+			}
+		}
+	}
+}
+
+// Another worker stores the list while our script is still queued
+func TestRedisStoreEdgesChangedWhileQueued(t *testing.T) {
+	m, r := testRedis(t)
+	s := NewRedisStore(r, 100)
+	s.PutEdges(store.TrackFavoriters, 1, []int{7, 8})
+	other, err := redis.Dial("tcp", m.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	key, hkey := s.key(store.TrackFavoriters, 1)
+	if _, err := other.Do("HSET", key, hkey, "9"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("got %v, want the list to have changed", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Errorf("the error was reported twice: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Abramovic/soundclouder/store"
+	"time"
+)
+
+// Why SoundCloud didn't give us a track or playlist. Any other error (a timeout, a 500) says
+// nothing about the id so it stays pending and is tried again on the next crawl.
+var (
+	ErrNotFound = errors.New("not found")
+	ErrPrivate  = errors.New("not public")
+	ErrBroken   = errors.New("unreadable response")
+	// Not about the id at all, SoundCloud doesn't take our client_id. Nothing will work until
+	// that's fixed so the workers stop.
+	ErrUnauthorized = errors.New("soundcloud rejected the client_id (401)")
+)
+
+// The tombstone reason for an error of GetTrack or GetPlaylist. false if the error doesn't mean
+// the id is dead.
+func DeadReason(err error) (string, bool) {
+	switch err {
+	case ErrNotFound:
+		// The store turns this into store.DeadDeleted if we crawled the id before
+		return store.DeadMissing, true
+	case ErrPrivate:
+		return store.DeadPrivate, true
+	case ErrBroken:
+		return store.DeadBroken, true
+	}
+	return "", false
+}
+
+// Only for the response to a request for one track or playlist, that's the only place a 403 says
+// something about the id.
+func (c *Crawler) checkStatus(status int) error {
+	switch {
+	case status == 404 || status == 410:
+		return ErrNotFound
+	case status == 401:
+		return ErrUnauthorized
+	case status == 403:
+		return ErrPrivate
+	case status == 429 || status >= 500:
+		// We most likely hit some issue with SoundCloud... time to back off
+		c.Wait()
+		return fmt.Errorf("soundcloud returned %d", status)
+	}
+	return nil
+}
+
+// Whether an id is dead and if it is, whether the recheck policy says it's time to look at it
+// again. An id that isn't dead is always due.
+func (c *Crawler) Recheck(g store.GraphStore, kind string, id int, now time.Time) (dead, due bool) {
+	t, ok, err := g.Tombstone(kind, id)
+	if err != nil || !ok {
+		return false, true
+	}
+	after, ok := c.Config.RecheckAfter(t.Reason)
+	if !ok {
+		return true, false
+	}
+	return true, !t.Checked.Add(after).After(now)
+}
+
+// Marks an id as dead. If its reason gets checked again the id is scheduled for then, so the
+// continuous crawler comes back to its batch. The lists of an id that was live until now are taken
+// out of the counters (see Revive).
+func (c *Crawler) Bury(g store.GraphStore, kind string, id int, reason string, now time.Time) store.Tombstone {
+	_, buried, err := g.Tombstone(kind, id)
+	if err != nil {
+		fmt.Println(err)
+		return store.Tombstone{}
+	}
+	t, err := g.MarkDead(kind, id, reason, now)
+	if err != nil {
+		fmt.Println(err)
+		return t
+	}
+	if !buried {
+		// Its lists are kept but they don't count anymore
+		for _, edge := range store.KindEdges(kind) {
+			if err := g.CountEdges(edge, id, -1); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+	if after, ok := c.Config.RecheckAfter(t.Reason); ok {
+		g.MarkCrawled(kind, id, now, now.Add(after))
+	}
+	return t
+}
+
+// A dead id turned out to be alive. The lists it had when it was buried go back into the counters
+// before it is stored, so its new lists are diffed against lists that count.
+func (c *Crawler) Revive(g store.GraphStore, kind string, id int) error {
+	for _, edge := range store.KindEdges(kind) {
+		if err := g.CountEdges(edge, id, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package crawler
+
+import (
+	"errors"
+	"github.com/Abramovic/soundclouder/config"
+	"github.com/Abramovic/soundclouder/store"
+	"testing"
+	"time"
+)
+
+func TestDeadReason(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason string
+		dead   bool
+	}{
+		{ErrNotFound, store.DeadMissing, true},
+		{ErrPrivate, store.DeadPrivate, true},
+		{ErrBroken, store.DeadBroken, true},
+		{ErrUnauthorized, "", false},
+		{ErrOverBudget, "", false},
+		{errors.New("timeout"), "", false},
+		{nil, "", false},
+	}
+	for _, test := range tests {
+		reason, dead := DeadReason(test.err)
+		if reason != test.reason || dead != test.dead {
+			t.Errorf("DeadReason(%v) = %q, %v, want %q, %v", test.err, reason, dead, test.reason, test.dead)
+		}
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	c := &Crawler{}
+	tests := []struct {
+		status int
+		err    error
+	}{
+		{200, nil},
+		{404, ErrNotFound},
+		{410, ErrNotFound},
+		{401, ErrUnauthorized},
+		{403, ErrPrivate},
+	}
+	for _, test := range tests {
+		if err := c.checkStatus(test.status); err != test.err {
+			t.Errorf("checkStatus(%d) = %v, want %v", test.status, err, test.err)
+		}
+	}
+}
+
+func TestRecheck(t *testing.T) {
+	now := time.Now()
+	c := &Crawler{Config: config.Configuration{Recheck: map[string]string{store.DeadPrivate: "1h"}}}
+	g := store.NewMemoryStore()
+	g.MarkDead(store.Tracks, 2, store.DeadMissing, now)
+	g.MarkDead(store.Tracks, 3, store.DeadPrivate, now.Add(-2*time.Hour))
+	g.MarkDead(store.Tracks, 4, store.DeadPrivate, now.Add(-time.Minute))
+	g.MarkDead(store.Tracks, 5, store.DeadBroken, now.Add(-25*time.Hour))
+
+	tests := []struct {
+		id        int
+		dead, due bool
+	}{
+		{1, false, true},
+		// Never checked again
+		{2, true, false},
+		{3, true, true},
+		{4, true, false},
+		// No recheck configured, the default applies
+		{5, true, true},
+	}
+	for _, test := range tests {
+		dead, due := c.Recheck(g, store.Tracks, test.id, now)
+		if dead != test.dead || due != test.due {
+			t.Errorf("Recheck(%d) = %v, %v, want %v, %v", test.id, dead, due, test.dead, test.due)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package crawler
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Set at build time with: go build -ldflags "-X github.com/Abramovic/soundclouder/crawler.Version=1.2.3"
+var Version = "dev"
+
+// Every worker adds itself to the Workers sorted set (scored by its last heartbeat) and keeps its
+// status in a worker:<id> hash that expires if the worker stops sending heartbeats.
+const (
+	Workers           = "workers"
+	HeartbeatInterval = 10 * time.Second
+	// A worker that hasn't sent a heartbeat for this long is flagged as silent
+	SilentAfter = 3 * HeartbeatInterval
+)
+
+var workerId string
+var workerIdOnce sync.Once
+
+// Identifies this process when several workers share one Redis. The start time is part of the id
+// so a restarted process that gets the same pid is still a different worker.
+func WorkerId() string {
+	workerIdOnce.Do(func() {
+		host, _ := os.Hostname()
+		workerId = fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().Unix())
+	})
+	return workerId
+}
+
+func WorkerKey(id string) string {
+	return Key("worker:" + id)
+}
+
+// Stats counts what this worker has done so far and which batches it is working on.
+type Stats struct {
+	mu       sync.Mutex
+	items    int64
+	errors   int64
+	requests int64
+	batches  map[string]time.Time
+}
+
+func NewStats() *Stats {
+	return &Stats{batches: map[string]time.Time{}}
+}
+
+func (s *Stats) StartBatch(kind string, batch_id int) {
+	s.mu.Lock()
+	s.batches[fmt.Sprintf("%s:%d", kind, batch_id)] = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *Stats) FinishBatch(kind string, batch_id int) {
+	s.mu.Lock()
+	delete(s.batches, fmt.Sprintf("%s:%d", kind, batch_id))
+	s.mu.Unlock()
+}
+
+// Called once for every track or playlist id that was looked at
+func (s *Stats) Item() {
+	s.mu.Lock()
+	s.items++
+	s.mu.Unlock()
+}
+
+// Called once for every request made to the SoundCloud API
+func (s *Stats) Request() {
+	s.mu.Lock()
+	s.requests++
+	s.mu.Unlock()
+}
+
+func (s *Stats) Requests() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Stats) Error() {
+	s.mu.Lock()
+	s.errors++
+	s.mu.Unlock()
+}
+
+func (s *Stats) snapshot() (int64, int64, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batches := []string{}
+	for b := range s.batches {
+		batches = append(batches, b)
+	}
+	sort.Strings(batches)
+	return s.items, s.errors, batches
+}
+
+// Sends a heartbeat every HeartbeatInterval for as long as the program runs. status is asked for
+// the current state of the worker ("running", "paused", "draining"...).
+func (c *Crawler) Heartbeat(status func() string) {
+	started := time.Now()
+	var lastItems int64
+	lastBeat := started
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		items, errors, batches := c.Stats.snapshot()
+		rate := 0.0
+		if elapsed := now.Sub(lastBeat).Seconds(); elapsed > 0 {
+			rate = float64(items-lastItems) / elapsed
+		}
+		lastItems, lastBeat = items, now
+
+		host, _ := os.Hostname()
+		r := c.RedisClient.Get()
+		key := WorkerKey(WorkerId())
+		r.Do("HMSET", key,
+			"host", host,
+			"pid", os.Getpid(),
+			"version", Version,
+			"started", started.Unix(),
+			"heartbeat", now.Unix(),
+			"status", status(),
+			"batches", strings.Join(batches, ","),
+			"items", items,
+			"items_per_sec", fmt.Sprintf("%.2f", rate),
+			"errors", errors,
+			"concurrency", c.Concurrency.Target(),
+		)
+		// Keep the hash around for a while after the worker goes silent so we can still see it
+		r.Do("EXPIRE", key, int(10*SilentAfter/time.Second))
+		r.Do("ZADD", Key(Workers), now.Unix(), WorkerId())
+		r.Close()
+
+		<-ticker.C
+	}
+}
+
+// Marks this worker as stopped so it isn't flagged as silent once it is gone.
+func (c *Crawler) Deregister() {
+	r := c.RedisClient.Get()
+	defer r.Close()
+	r.Do("HMSET", WorkerKey(WorkerId()), "status", "stopped", "batches", "", "heartbeat", time.Now().Unix())
+}
+
+type WorkerInfo struct {
+	Id     string
+	Silent bool
+	Fields map[string]string
+}
+
+// Lists every worker we have heard from. Workers whose status hash has expired are removed.
+func ListWorkers(r redis.Conn) ([]WorkerInfo, error) {
+	beats, err := redis.Int64Map(r.Do("ZRANGE", Key(Workers), 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	workers := []WorkerInfo{}
+	for id, beat := range beats {
+		fields, err := redis.StringMap(r.Do("HGETALL", WorkerKey(id)))
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			r.Do("ZREM", Key(Workers), id)
+			continue
+		}
+		silent := now.Sub(time.Unix(beat, 0)) > SilentAfter && fields["status"] != "stopped"
+		workers = append(workers, WorkerInfo{Id: id, Silent: silent, Fields: fields})
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Id < workers[j].Id })
+	return workers, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Abramovic/soundclouder/crawler"
+	"github.com/Abramovic/soundclouder/store"
+	"os"
+)
+
+// "./soundclouder migrate-edges varint" rewrites every stored edge list in another format. Set
+// "edge_format" to the same format first so the workers don't keep writing the old one.
+func (c *Crawler) migrateEdges(format string) {
+	if format == "" {
+		fmt.Println("usage: soundclouder migrate-edges csv|varint|varint-deflate")
+		os.Exit(1)
+	}
+	// Not setting it at all means the default
+	configured := c.Config.EdgeFormat
+	if configured == "" {
+		configured = store.EdgesCSV
+	}
+	if format != configured {
+		fmt.Printf("Warning: edge_format in the config is %q, workers will keep writing that\n", configured)
+	}
+	r := c.RedisClient.Get()
+	defer r.Close()
+	n, err := crawler.MigrateEdges(r, format, func(edge string, lists int) {
+		fmt.Printf("%s: %d lists rewritten\n", edge, lists)
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Done, %d edge lists are now %s\n", n, format)
+}
@@ -8,3 +8,12 @@ func AppendSlice(slice []string, i string) []string {
 	}
 	return append(slice, i)
 }
+
+func AppendInt(slice []int, i int) []int {
+	for _, ele := range slice {
+		if ele == i {
+			return slice
+		}
+	}
+	return append(slice, i)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Abramovic/soundclouder/crawler"
+	"github.com/Abramovic/soundclouder/store"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// "./soundclouder migrate-models msgpack" rewrites every stored track and user in another format.
+// Set "model_format" to the same format first so the workers don't keep writing the old one.
+func (c *Crawler) migrateModels(format string) {
+	if format == "" {
+		fmt.Println("usage: soundclouder migrate-models json|msgpack|msgpack-deflate")
+		os.Exit(1)
+	}
+	// Not setting it at all means the default
+	configured := c.Config.ModelFormat
+	if configured == "" {
+		configured = store.ModelsJSON
+	}
+	if format != configured {
+		fmt.Printf("Warning: model_format in the config is %q, workers will keep writing that\n", configured)
+	}
+	r := c.RedisClient.Get()
+	defer r.Close()
+	n, err := crawler.MigrateModels(r, format, func(hash string, values int) {
+		fmt.Printf("%s: %d values rewritten\n", hash, values)
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Done, %d tracks and users are now %s\n", n, format)
+}
+
+// "./soundclouder model-report 10000" stores a sample of the crawled tracks and users again in
+// every format and prints how much room each one takes.
+func (c *Crawler) modelReport(arg string) {
+	sample := 10000
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			fmt.Println("usage: soundclouder model-report [values]")
+			os.Exit(1)
+		}
+		sample = n
+	}
+	r := c.RedisClient.Get()
+	defer r.Close()
+	sizes, err := crawler.ModelReport(r, sample)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HASH\tFORMAT\tVALUES\tBYTES/VALUE\tREDIS BYTES/VALUE\tVS JSON")
+	jsonSize := map[string]crawler.ModelSize{}
+	for _, size := range sizes {
+		if size.Format == store.ModelsJSON {
+			jsonSize[size.Hash] = size
+		}
+		if size.Values == 0 {
+			fmt.Fprintf(w, "%s\t%s\t0\t-\t-\t-\n", size.Hash, size.Format)
+			continue
+		}
+		redisBytes := "-"
+		if size.RedisBytes >= 0 {
+			redisBytes = strconv.FormatInt(size.RedisBytes/int64(size.Values), 10)
+		}
+		// Compare what Redis says if it can tell, otherwise the values themselves
+		base, now := jsonSize[size.Hash].RedisBytes, size.RedisBytes
+		if base <= 0 || now < 0 {
+			base, now = jsonSize[size.Hash].Bytes, size.Bytes
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%.0f%%\n", size.Hash, size.Format, size.Values,
+			size.Bytes/int64(size.Values), redisBytes, 100*float64(now)/float64(base))
+	}
+	w.Flush()
+}
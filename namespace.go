@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Abramovic/soundclouder/crawler"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// "./soundclouder namespace list", "namespace copy <from> <to>", "namespace delete <name>",
+// "namespace dump <name> <file>" and "namespace restore <file> <name>"
+func (c *Crawler) namespace(args []string) {
+	usage := func() {
+		fmt.Println("usage: soundclouder namespace list | copy <from> <to> | delete <name> | dump <name> <file> | restore <file> <name>")
+		os.Exit(1)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	if c.Config.Cluster {
+		// The namespaces of a cluster live in different slots and we only talk to one node
+		fmt.Println("the namespace command doesn't work on a Redis Cluster")
+		os.Exit(1)
+	}
+	r := c.RedisClient.Get()
+	defer r.Close()
+	progress := func(n int) {
+		fmt.Println(n, "keys")
+	}
+
+	switch args[0] {
+	case "list":
+		namespaces, err := crawler.ListNamespaces(r)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		names := []string{}
+		for name := range namespaces {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAMESPACE\tKEYS")
+		for _, name := range names {
+			fmt.Fprintf(w, "%s\t%d\n", name, namespaces[name])
+		}
+		w.Flush()
+	case "copy":
+		if len(args) != 3 {
+			usage()
+		}
+		n, err := crawler.CopyNamespace(r, args[1], args[2], progress)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Copied %d keys from %s to %s\n", n, namespaceName(args[1]), args[2])
+	case "delete":
+		if len(args) != 2 {
+			usage()
+		}
+		n, err := crawler.DeleteNamespace(r, args[1], progress)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Deleted %d keys from %s\n", n, args[1])
+	case "dump":
+		if len(args) != 3 {
+			usage()
+		}
+		n, err := crawler.DumpNamespace(r, args[1], args[2], progress)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Dumped %d keys from %s to %s\n", n, namespaceName(args[1]), args[2])
+	case "restore":
+		if len(args) != 3 {
+			usage()
+		}
+		n, err := crawler.RestoreNamespace(r, args[1], args[2], progress)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored %d keys from %s to %s\n", n, args[1], args[2])
+	default:
+		usage()
+	}
+}
+
+// The crawl without a namespace is "" on the command line
+func namespaceName(name string) string {
+	if name == "" {
+		return "the crawl without a namespace"
+	}
+	return name
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Abramovic/soundclouder/crawler"
+	"os"
+	"text/tabwriter"
+)
+
+// How many wrong ids of each counter are printed
+const reconcileExamples = 20
+
+// "./soundclouder reconcile" reports how far the trackCount* counters are off from the edge lists,
+// "./soundclouder reconcile fix" rewrites them too. Drain the workers first.
+func (c *Crawler) reconcile(action string) {
+	if action != "" && action != "fix" {
+		fmt.Println("usage: soundclouder reconcile [fix]")
+		os.Exit(1)
+	}
+	r := c.RedisClient.Get()
+	defer r.Close()
+	shown := map[string]int{}
+	reports, err := crawler.Reconcile(r, action == "fix", func(d crawler.CounterDiff) {
+		if shown[d.Counter] < reconcileExamples {
+			fmt.Printf("%s %d: stored %d, counted %d\n", d.Counter, d.Id, d.Stored, d.Counted)
+		}
+		shown[d.Counter]++
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COUNTER\tIDS\tWRONG\tDRIFT")
+	for _, report := range reports {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%+d\n", report.Counter, report.Ids, report.Wrong, report.Drift)
+	}
+	w.Flush()
+	if action == "fix" {
+		fmt.Println("The wrong counters were rewritten")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Abramovic/soundclouder/crawler"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+func sampleKinds() []string {
+	if *only != "" {
+		return []string{*only}
+	}
+	return []string{"tracks", "playlists"}
+}
+
+// Crawls a uniform random sample of tracks and playlists. Running it again finishes the same
+// sample, use -force=true to throw it away and take a new one.
+func (c *Crawler) sample(max_id int) {
+	r := c.RedisClient.Get()
+	defer r.Close()
+
+	for _, kind := range sampleKinds() {
+		if stopped() {
+			return
+		}
+		population := max_id
+		if kind == "playlists" {
+			population = *maxPlaylist
+		}
+		s, err := crawler.LoadSample(r, kind)
+		if err != nil && err != crawler.ErrNoSample {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err == crawler.ErrNoSample || *force {
+			crawler.ClearSample(r, kind)
+			s = crawler.Sample{Kind: kind, By: *sampleBy, Rate: *sampleRate, Population: population, Seed: time.Now().UnixNano()}
+			if err := crawler.SaveSample(r, s); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		} else if s.Rate != *sampleRate || s.By != *sampleBy {
+			fmt.Printf("Finishing the existing %s sample (rate %g by %s). Use -force=true to start a new one.\n", kind, s.Rate, s.By)
+		}
+
+		units := s.Units()
+		fmt.Printf("Sampling %d of %d %s units\n", len(units), s.PopulationUnits(), kind)
+		c.sampleUnits(s, units)
+	}
+}
+
+func (c *Crawler) sampleUnits(s crawler.Sample, units []int) {
+	work := make(chan int, max_workers)
+	var monitor sync.WaitGroup
+	monitor.Add(max_workers)
+	for i := 0; i < max_workers; i++ {
+		go func() {
+			defer monitor.Done()
+			r := c.RedisClient.Get()
+			defer r.Close()
+			for unit := range work {
+				if crawler.SampleDone(r, s, unit) || !c.Concurrency.Acquire() {
+					continue
+				}
+				if err := c.SampleUnit(r, s, unit); err != nil {
+					fmt.Println(err)
+				}
+				c.Stats.Item()
+				c.Concurrency.Release()
+			}
+		}()
+	}
+	for _, unit := range units {
+		select {
+		case work <- unit:
+		case <-stopping:
+		}
+		if stopped() {
+			break
+		}
+	}
+	close(work)
+	monitor.Wait()
+}
+
+// Prints the estimates for the whole population with 95% confidence intervals.
+func (c *Crawler) sampleReport() {
+	r := c.RedisClient.Get()
+	defer r.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, kind := range sampleKinds() {
+		s, err := crawler.LoadSample(r, kind)
+		if err != nil {
+			fmt.Fprintf(w, "%s: %s\n", kind, err)
+			continue
+		}
+		estimates, n, err := crawler.SampleEstimates(r, s)
+		if err != nil {
+			fmt.Fprintf(w, "%s: %s\n", kind, err)
+			continue
+		}
+		fmt.Fprintf(w, "\n%s: %d of %d units sampled by %s (rate %g, max id %d)\n", kind, n, s.PopulationUnits(), s.By, s.Rate, s.Population)
+		fmt.Fprintln(w, "ESTIMATE\tVALUE\t95% CI")
+		for _, e := range estimates {
+			fmt.Fprintf(w, "%s\t%.4f\t%.4f - %.4f\n", e.Name, e.Value, e.Low, e.High)
+		}
+	}
+	w.Flush()
+}
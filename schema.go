@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Abramovic/soundclouder/crawler"
+	"os"
+)
+
+// "./soundclouder schema" prints the layout version and what is still pending,
+// "./soundclouder schema migrate" runs the pending migrations. Stop the workers first.
+func (c *Crawler) schema(action string) {
+	r := c.RedisClient.Get()
+	defer r.Close()
+	version, err := crawler.SchemaVersion(r)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	pending, err := crawler.PendingMigrations(r)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	switch action {
+	case "":
+		fmt.Printf("Schema version %d, the latest is %d\n", version, crawler.LatestSchema())
+		for _, m := range pending {
+			fmt.Printf("  pending: %d %s\n", m.Version, m.Name)
+		}
+	case "migrate":
+		err := crawler.Migrate(r, func(m crawler.Migration, hash string, keys int) {
+			fmt.Printf("%d %s: %s done (%d hashes)\n", m.Version, m.Name, hash, keys)
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Schema version %d\n", crawler.LatestSchema())
+	default:
+		fmt.Println("usage: soundclouder schema [migrate]")
+		os.Exit(1)
+	}
+}
+
+// Workers only crawl a namespace that is on the layout they know
+func (c *Crawler) checkSchema() {
+	r := c.RedisClient.Get()
+	defer r.Close()
+	pending, err := crawler.PendingMigrations(r)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(pending) > 0 {
+		fmt.Printf("This crawl needs %d migration(s) first, run \"soundclouder schema migrate\"\n", len(pending))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,482 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/Abramovic/soundclouder/models"
+	bolt "go.etcd.io/bbolt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bucket names. The state of an id (pending or crawled) is kept in "<kind>" and the crawl times in
+// "<kind>LastCrawl" / "<kind>NextCrawl" just like the Redis hashes.
+var (
+	trackBucket = []byte("trackMeta")
+	userBucket  = []byte("userMeta")
+	metaBucket  = []byte("meta")
+)
+
+const (
+	pending byte = 0
+	crawled byte = 1
+)
+
+// Returned by Pop on a bolt queue without anything left in it
+var ErrEmpty = errors.New("queue is empty")
+
+// BoltStore keeps the graph in a single bbolt file on local disk. It is meant for crawls that
+// run on one machine, so besides the graph it also holds the queues and a few settings that
+// would otherwise live in Redis. One BoltStore is shared by all of the workers.
+//
+// Ids are stored as 8 byte big endian keys so the ids of a batch sit next to each other.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func idKey(id int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(id))
+	return k
+}
+
+func keyId(k []byte) int {
+	return int(binary.BigEndian.Uint64(k))
+}
+
+func int64Value(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+// Workers write at the same time a lot so the writes go through Batch, which puts the writes of
+// many goroutines into one transaction. The function may run more than once.
+func (b *BoltStore) update(fn func(tx *bolt.Tx) error) error {
+	return b.db.Batch(fn)
+}
+
+func (b *BoltStore) AddPending(kind string, ids []int) (int, error) {
+	added := 0
+	err := b.update(func(tx *bolt.Tx) error {
+		added = 0
+		state, err := tx.CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if state.Get(idKey(id)) != nil {
+				continue
+			}
+			if err := state.Put(idKey(id), []byte{pending}); err != nil {
+				return err
+			}
+			added++
+		}
+		return nil
+	})
+	return added, err
+}
+
+func (b *BoltStore) Ids(kind string, first, last int) ([]int, error) {
+	ids := []int{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		state := tx.Bucket([]byte(kind))
+		if state == nil {
+			return nil
+		}
+		c := state.Cursor()
+		for k, _ := c.Seek(idKey(first)); k != nil && keyId(k) <= last; k, _ = c.Next() {
+			ids = append(ids, keyId(k))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (b *BoltStore) IsPending(kind string, id int) (bool, error) {
+	found := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if state := tx.Bucket([]byte(kind)); state != nil {
+			found = state.Get(idKey(id)) != nil
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Tombstones go into "<kind>Tombstones" like in Redis
+func (b *BoltStore) MarkDead(kind string, id int, reason string, at time.Time) (Tombstone, error) {
+	var t Tombstone
+	err := b.update(func(tx *bolt.Tx) error {
+		tombstones, err := tx.CreateBucketIfNotExists([]byte(kind + "Tombstones"))
+		if err != nil {
+			return err
+		}
+		old, buried := Tombstone{}, false
+		if v := tombstones.Get(idKey(id)); v != nil {
+			old, err = ParseTombstone(string(v))
+			buried = err == nil
+		}
+		had := false
+		if state := tx.Bucket([]byte(kind)); state != nil {
+			v := state.Get(idKey(id))
+			had = len(v) == 1 && v[0] == crawled
+		}
+		t = Bury(old, buried, reason, had, at)
+		if err := tombstones.Put(idKey(id), []byte(t.String())); err != nil {
+			return err
+		}
+		if nexts := tx.Bucket([]byte(kind + "NextCrawl")); nexts != nil {
+			return nexts.Delete(idKey(id))
+		}
+		return nil
+	})
+	return t, err
+}
+
+func (b *BoltStore) Tombstone(kind string, id int) (Tombstone, bool, error) {
+	var t Tombstone
+	ok := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		tombstones := tx.Bucket([]byte(kind + "Tombstones"))
+		if tombstones == nil {
+			return nil
+		}
+		v := tombstones.Get(idKey(id))
+		if v == nil {
+			return nil
+		}
+		var err error
+		t, err = ParseTombstone(string(v))
+		ok = err == nil
+		return err
+	})
+	return t, ok, err
+}
+
+// Storing something for an id means it's alive, so it loses its tombstone
+func (b *BoltStore) markCrawled(tx *bolt.Tx, kind string, id int) error {
+	state, err := tx.CreateBucketIfNotExists([]byte(kind))
+	if err != nil {
+		return err
+	}
+	if err := state.Put(idKey(id), []byte{crawled}); err != nil {
+		return err
+	}
+	if tombstones := tx.Bucket([]byte(kind + "Tombstones")); tombstones != nil {
+		return tombstones.Delete(idKey(id))
+	}
+	return nil
+}
+
+func (b *BoltStore) PutTrack(track *models.Track) error {
+	j, err := json.Marshal(track)
+	if err != nil {
+		return err
+	}
+	return b.update(func(tx *bolt.Tx) error {
+		tracks, err := tx.CreateBucketIfNotExists(trackBucket)
+		if err != nil {
+			return err
+		}
+		if err := tracks.Put(idKey(track.Id), j); err != nil {
+			return err
+		}
+		return b.markCrawled(tx, Tracks, track.Id)
+	})
+}
+
+func (b *BoltStore) PutUser(user models.UserPreview) (bool, error) {
+	j, err := json.Marshal(user)
+	if err != nil {
+		return false, err
+	}
+	added := false
+	err = b.update(func(tx *bolt.Tx) error {
+		added = false
+		users, err := tx.CreateBucketIfNotExists(userBucket)
+		if err != nil {
+			return err
+		}
+		if users.Get(idKey(user.Id)) != nil {
+			return nil
+		}
+		added = true
+		return users.Put(idKey(user.Id), j)
+	})
+	return added, err
+}
+
+// Edges are stored as a comma separated list of ids like in Redis
+func (b *BoltStore) PutEdges(edge string, id int, ids []int) (int, int, error) {
+	list := make([]string, len(ids))
+	for i, id := range ids {
+		list[i] = strconv.Itoa(id)
+	}
+	var added, removed []int
+	err := b.update(func(tx *bolt.Tx) error {
+		edges, err := tx.CreateBucketIfNotExists([]byte(edge))
+		if err != nil {
+			return err
+		}
+		added, removed = EdgeDiff(splitIds(edges.Get(idKey(id))), ids)
+		if err := edges.Put(idKey(id), []byte(strings.Join(list, ","))); err != nil {
+			return err
+		}
+		counter, perMember := EdgeCounter(edge)
+		if perMember {
+			for _, member := range added {
+				if err := boltIncr(tx, counter, member, 1); err != nil {
+					return err
+				}
+			}
+			for _, member := range removed {
+				if err := boltIncr(tx, counter, member, -1); err != nil {
+					return err
+				}
+			}
+		} else if len(added) != len(removed) {
+			if err := boltIncr(tx, counter, id, len(added)-len(removed)); err != nil {
+				return err
+			}
+		}
+		if edge == PlaylistTracks {
+			return b.markCrawled(tx, Playlists, id)
+		}
+		return nil
+	})
+	return len(added), len(removed), err
+}
+
+func (b *BoltStore) CountEdges(edge string, id, by int) error {
+	return b.update(func(tx *bolt.Tx) error {
+		edges := tx.Bucket([]byte(edge))
+		if edges == nil {
+			return nil
+		}
+		return CountEdgeList(edge, id, splitIds(edges.Get(idKey(id))), by, func(counter string, id, by int) error {
+			return boltIncr(tx, counter, id, by)
+		})
+	})
+}
+
+func splitIds(v []byte) []int {
+	ids := []int{}
+	if len(v) == 0 {
+		return ids
+	}
+	for _, s := range strings.Split(string(v), ",") {
+		if id, err := strconv.Atoi(s); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func boltIncr(tx *bolt.Tx, counter string, id, by int) error {
+	counters, err := tx.CreateBucketIfNotExists([]byte(counter))
+	if err != nil {
+		return err
+	}
+	n := int64(0)
+	if v := counters.Get(idKey(id)); len(v) == 8 {
+		n = int64(binary.BigEndian.Uint64(v))
+	}
+	return counters.Put(idKey(id), int64Value(n+int64(by)))
+}
+
+func (b *BoltStore) IncrementCounter(counter string, id, by int) error {
+	return b.update(func(tx *bolt.Tx) error {
+		return boltIncr(tx, counter, id, by)
+	})
+}
+
+func (b *BoltStore) MarkCrawled(kind string, id int, at, next time.Time) error {
+	return b.update(func(tx *bolt.Tx) error {
+		last, err := tx.CreateBucketIfNotExists([]byte(kind + "LastCrawl"))
+		if err != nil {
+			return err
+		}
+		if err := last.Put(idKey(id), int64Value(at.Unix())); err != nil {
+			return err
+		}
+		nexts, err := tx.CreateBucketIfNotExists([]byte(kind + "NextCrawl"))
+		if err != nil {
+			return err
+		}
+		return nexts.Put(idKey(id), int64Value(next.Unix()))
+	})
+}
+
+func (b *BoltStore) NextCrawl(kind string, id int) (time.Time, bool, error) {
+	var next time.Time
+	ok := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		nexts := tx.Bucket([]byte(kind + "NextCrawl"))
+		if nexts == nil {
+			return nil
+		}
+		if v := nexts.Get(idKey(id)); len(v) == 8 {
+			next, ok = time.Unix(int64(binary.BigEndian.Uint64(v)), 0), true
+		}
+		return nil
+	})
+	return next, ok, err
+}
+
+func (b *BoltStore) EarliestNextCrawl(kind string, first, last int) (time.Time, bool, error) {
+	var earliest time.Time
+	ok := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		nexts := tx.Bucket([]byte(kind + "NextCrawl"))
+		if nexts == nil {
+			return nil
+		}
+		c := nexts.Cursor()
+		for k, v := c.Seek(idKey(first)); k != nil && keyId(k) <= last; k, v = c.Next() {
+			next := time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+			if !ok || next.Before(earliest) {
+				earliest, ok = next, true
+			}
+		}
+		return nil
+	})
+	return earliest, ok, err
+}
+
+// Every write is committed before it returns so there is nothing to flush
+func (b *BoltStore) Flush() error {
+	return nil
+}
+
+// The file stays open for the other workers. Use CloseFile once the crawl is done.
+func (b *BoltStore) Close() error {
+	return nil
+}
+
+func (b *BoltStore) CloseFile() error {
+	return b.db.Close()
+}
+
+// Settings like the batch size and the seed marker
+func (b *BoltStore) Meta(key string) (string, bool, error) {
+	value, ok := "", false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(metaBucket); meta != nil {
+			if v := meta.Get([]byte(key)); v != nil {
+				value, ok = string(v), true
+			}
+		}
+		return nil
+	})
+	return value, ok, err
+}
+
+func (b *BoltStore) SetMeta(key, value string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte(key), []byte(value))
+	})
+}
+
+// A queue is two buckets just like the Redis sets: "queue:<name>" with the batches waiting to be
+// crawled and "queue:<name>:todo" with the ones that were handed out but not finished yet.
+func (b *BoltStore) Push(queue string, batch_id int) error {
+	return b.update(func(tx *bolt.Tx) error {
+		q, err := tx.CreateBucketIfNotExists([]byte("queue:" + queue))
+		if err != nil {
+			return err
+		}
+		return q.Put(idKey(batch_id), []byte{})
+	})
+}
+
+// Batches come out highest first, the same order they are seeded in.
+func (b *BoltStore) Pop(queue string) (int, error) {
+	batch_id := -1
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		batch_id = -1
+		q := tx.Bucket([]byte("queue:" + queue))
+		if q == nil {
+			return nil
+		}
+		k, _ := q.Cursor().Last()
+		if k == nil {
+			return nil
+		}
+		batch_id = keyId(k)
+		if err := q.Delete(k); err != nil {
+			return err
+		}
+		todo, err := tx.CreateBucketIfNotExists([]byte("queue:" + queue + ":todo"))
+		if err != nil {
+			return err
+		}
+		return todo.Put(idKey(batch_id), []byte{})
+	})
+	if err == nil && batch_id < 0 {
+		return 0, ErrEmpty
+	}
+	return batch_id, err
+}
+
+func (b *BoltStore) Ack(queue string, batch_id int) error {
+	return b.update(func(tx *bolt.Tx) error {
+		if todo := tx.Bucket([]byte("queue:" + queue + ":todo")); todo != nil {
+			return todo.Delete(idKey(batch_id))
+		}
+		return nil
+	})
+}
+
+// Moves a batch that was handed out back onto the queue in one transaction
+func (b *BoltStore) Requeue(queue string, batch_id int) error {
+	return b.update(func(tx *bolt.Tx) error {
+		q, err := tx.CreateBucketIfNotExists([]byte("queue:" + queue))
+		if err != nil {
+			return err
+		}
+		if err := q.Put(idKey(batch_id), []byte{}); err != nil {
+			return err
+		}
+		if todo := tx.Bucket([]byte("queue:" + queue + ":todo")); todo != nil {
+			return todo.Delete(idKey(batch_id))
+		}
+		return nil
+	})
+}
+
+// Puts everything that was handed out but never acked back onto the queue
+func (b *BoltStore) Restart(queue string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		todo := tx.Bucket([]byte("queue:" + queue + ":todo"))
+		if todo == nil {
+			return nil
+		}
+		q, err := tx.CreateBucketIfNotExists([]byte("queue:" + queue))
+		if err != nil {
+			return err
+		}
+		c := todo.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if err := q.Put(k, []byte{}); err != nil {
+				return err
+			}
+		}
+		return tx.DeleteBucket([]byte("queue:" + queue + ":todo"))
+	})
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBoltQueue(t *testing.T) {
+	b, err := OpenBolt(filepath.Join(t.TempDir(), "crawl.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.CloseFile()
+
+	steps := []struct {
+		name string
+		do   func() (int, error)
+		want int
+		err  error
+	}{
+		{"pop from nothing", func() (int, error) { return b.Pop("q") }, 0, ErrEmpty},
+		{"push 1", func() (int, error) { return 0, b.Push("q", 1) }, 0, nil},
+		{"push 3", func() (int, error) { return 0, b.Push("q", 3) }, 0, nil},
+		{"push 2", func() (int, error) { return 0, b.Push("q", 2) }, 0, nil},
+		{"highest first", func() (int, error) { return b.Pop("q") }, 3, nil},
+		{"ack it", func() (int, error) { return 0, b.Ack("q", 3) }, 0, nil},
+		{"next one", func() (int, error) { return b.Pop("q") }, 2, nil},
+		{"give it back", func() (int, error) { return 0, b.Requeue("q", 2) }, 0, nil},
+		{"it comes back", func() (int, error) { return b.Pop("q") }, 2, nil},
+		{"last one", func() (int, error) { return b.Pop("q") }, 1, nil},
+		{"empty", func() (int, error) { return b.Pop("q") }, 0, ErrEmpty},
+		// 2 and 1 were popped and never acked
+		{"restart", func() (int, error) { return 0, b.Restart("q") }, 0, nil},
+		{"after restart", func() (int, error) { return b.Pop("q") }, 2, nil},
+		{"after restart again", func() (int, error) { return b.Pop("q") }, 1, nil},
+		{"nothing left", func() (int, error) { return b.Pop("q") }, 0, ErrEmpty},
+	}
+	for _, step := range steps {
+		got, err := step.do()
+		if got != step.want || err != step.err {
+			t.Fatalf("%s: got %d (%v), want %d (%v)", step.name, got, err, step.want, step.err)
+		}
+	}
+}
+
+func TestBoltMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crawl.bolt")
+	b, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := b.Meta("batchSize"); ok || err != nil {
+		t.Errorf("a new file has a batch size (%v)", err)
+	}
+	if err := b.SetMeta("batchSize", "500"); err != nil {
+		t.Fatal(err)
+	}
+	b.AddPending(Tracks, []int{1, 2})
+	b.CloseFile()
+
+	// Everything is still there after the file is opened again
+	b, err = OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.CloseFile()
+	if v, ok, err := b.Meta("batchSize"); !ok || v != "500" || err != nil {
+		t.Errorf("batch size is %q (%v)", v, err)
+	}
+	if ids, _ := b.Ids(Tracks, 0, 999); !reflect.DeepEqual(ids, []int{1, 2}) {
+		t.Errorf("batch 0 is %v after opening the file again", ids)
+	}
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack"
+	"io"
+	"io/ioutil"
+)
+
+// How tracks and users are stored. JSON is the original format. MessagePack leaves out every empty
+// field (most tracks have a dozen empty strings) and keeps numbers as small as they are.
+// msgpack-deflate compresses that too, which only pays off for tracks with long descriptions.
+const (
+	ModelsJSON           = "json"
+	ModelsMsgpack        = "msgpack"
+	ModelsMsgpackDeflate = "msgpack-deflate"
+)
+
+// A JSON value always starts with "{" (or "null" for a pending id) so a tag byte in front of the
+// other formats tells them apart.
+const (
+	tagMsgpack        byte = 1
+	tagMsgpackDeflate byte = 2
+)
+
+var ModelFormats = []string{ModelsJSON, ModelsMsgpack, ModelsMsgpackDeflate}
+
+func ValidModelFormat(format string) error {
+	switch format {
+	case "", ModelsJSON, ModelsMsgpack, ModelsMsgpackDeflate:
+		return nil
+	}
+	return fmt.Errorf("unknown model format %q", format)
+}
+
+// The format a stored value is in
+func ModelFormat(v []byte) string {
+	if len(v) > 0 {
+		switch v[0] {
+		case tagMsgpack:
+			return ModelsMsgpack
+		case tagMsgpackDeflate:
+			return ModelsMsgpackDeflate
+		}
+	}
+	return ModelsJSON
+}
+
+// Encodes a track or user in format ("" is JSON)
+func EncodeModel(model interface{}, format string) ([]byte, error) {
+	switch format {
+	case "", ModelsJSON:
+		return json.Marshal(model)
+	case ModelsMsgpack, ModelsMsgpackDeflate:
+		var b bytes.Buffer
+		if format == ModelsMsgpack {
+			b.WriteByte(tagMsgpack)
+			if err := packModel(&b, model); err != nil {
+				return nil, err
+			}
+			return b.Bytes(), nil
+		}
+		b.WriteByte(tagMsgpackDeflate)
+		w, err := flate.NewWriter(&b, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if err := packModel(w, model); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	return nil, ValidModelFormat(format)
+}
+
+// Field names come from the json tags so both formats use the same names
+func packModel(w io.Writer, model interface{}) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	enc.UseCompactInts(true)
+	enc.UseCompactFloats(true)
+	return enc.Encode(model)
+}
+
+// Reads a stored track or user in any of the formats
+func DecodeModel(v []byte, model interface{}) error {
+	switch ModelFormat(v) {
+	case ModelsMsgpack:
+		return unpackModel(v[1:], model)
+	case ModelsMsgpackDeflate:
+		body, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(v[1:])))
+		if err != nil {
+			return err
+		}
+		return unpackModel(body, model)
+	}
+	return json.Unmarshal(v, model)
+}
+
+func unpackModel(b []byte, model interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(b))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(model)
+}
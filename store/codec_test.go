@@ -0,0 +1,70 @@
+package store
+
+import (
+	"github.com/Abramovic/soundclouder/models"
+	"reflect"
+	"testing"
+)
+
+func TestModelRoundTrip(t *testing.T) {
+	track := models.Track{
+		Id:          12,
+		Title:       "twelve",
+		Duration:    180000,
+		Commentable: true,
+		Description: "a long description that deflate has something to do with, a long description",
+		User:        models.UserPreview{Id: 7, Permalink: "seven"},
+	}
+	tests := []struct {
+		format string
+		tag    string
+	}{
+		{"", ModelsJSON},
+		{ModelsJSON, ModelsJSON},
+		{ModelsMsgpack, ModelsMsgpack},
+		{ModelsMsgpackDeflate, ModelsMsgpackDeflate},
+	}
+	for _, test := range tests {
+		v, err := EncodeModel(&track, test.format)
+		if err != nil {
+			t.Fatalf("%q: %v", test.format, err)
+		}
+		if got := ModelFormat(v); got != test.tag {
+			t.Errorf("%q is read back as %q", test.format, got)
+		}
+		var decoded models.Track
+		if err := DecodeModel(v, &decoded); err != nil {
+			t.Fatalf("%q: %v", test.format, err)
+		}
+		if !reflect.DeepEqual(decoded, track) {
+			t.Errorf("%q: got %+v, want %+v", test.format, decoded, track)
+		}
+	}
+}
+
+func TestModelFormat(t *testing.T) {
+	tests := []struct {
+		v    string
+		want string
+	}{
+		{"", ModelsJSON},
+		{"null", ModelsJSON},
+		{`{"id":1}`, ModelsJSON},
+		{"\x01\x80", ModelsMsgpack},
+		{"\x02", ModelsMsgpackDeflate},
+	}
+	for _, test := range tests {
+		if got := ModelFormat([]byte(test.v)); got != test.want {
+			t.Errorf("%q is %q, want %q", test.v, got, test.want)
+		}
+	}
+}
+
+func TestUnknownModelFormat(t *testing.T) {
+	if err := ValidModelFormat("xml"); err == nil {
+		t.Error("xml is a valid format")
+	}
+	if _, err := EncodeModel(&models.Track{}, "xml"); err == nil {
+		t.Error("encoded a track as xml")
+	}
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// How an edge list is stored. CSV is the original comma separated list of ids. The varint formats
+// store how far each id is from the one before it as a varint, which for a sorted list of 50k
+// favoriters is a byte or two per id instead of eight or nine. varint-deflate compresses that too.
+const (
+	EdgesCSV           = "csv"
+	EdgesVarint        = "varint"
+	EdgesVarintDeflate = "varint-deflate"
+)
+
+// The binary formats start with a tag byte that can never be the first byte of a CSV list
+const (
+	tagVarint        byte = 1
+	tagVarintDeflate byte = 2
+)
+
+var ErrBadEdges = errors.New("edge list is corrupt")
+
+// Lists where the order means something. Every other list is sorted before it is encoded as
+// varints so the gaps between ids stay small.
+var orderedEdges = map[string]bool{
+	PlaylistTracks: true,
+}
+
+func ValidEdgeFormat(format string) error {
+	switch format {
+	case "", EdgesCSV, EdgesVarint, EdgesVarintDeflate:
+		return nil
+	}
+	return fmt.Errorf("unknown edge format %q", format)
+}
+
+// The format a stored list is in. A pending id ("null") and an empty value count as CSV.
+func EdgeFormat(v []byte) string {
+	if len(v) > 0 {
+		switch v[0] {
+		case tagVarint:
+			return EdgesVarint
+		case tagVarintDeflate:
+			return EdgesVarintDeflate
+		}
+	}
+	return EdgesCSV
+}
+
+// Encodes the list of an edge in format ("" is CSV)
+func EncodeEdges(edge string, ids []int, format string) ([]byte, error) {
+	switch format {
+	case "", EdgesCSV:
+		list := make([]string, len(ids))
+		for i, id := range ids {
+			list[i] = strconv.Itoa(id)
+		}
+		return []byte(strings.Join(list, ",")), nil
+	case EdgesVarint:
+		return append([]byte{tagVarint}, varints(edge, ids)...), nil
+	case EdgesVarintDeflate:
+		var b bytes.Buffer
+		b.WriteByte(tagVarintDeflate)
+		w, err := flate.NewWriter(&b, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(varints(edge, ids)); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	return nil, ValidEdgeFormat(format)
+}
+
+// The number of ids followed by the difference of every id to the one before it. The differences
+// are signed so a list that isn't sorted (tracks of a playlist) still works.
+func varints(edge string, ids []int) []byte {
+	if !orderedEdges[edge] {
+		ids = append([]int{}, ids...)
+		sort.Ints(ids)
+	}
+	b := make([]byte, binary.MaxVarintLen64*(len(ids)+1))
+	n := binary.PutUvarint(b, uint64(len(ids)))
+	prev := 0
+	for _, id := range ids {
+		n += binary.PutVarint(b[n:], int64(id-prev))
+		prev = id
+	}
+	return b[:n]
+}
+
+// Reads a stored list in any of the formats
+func DecodeEdges(v []byte) ([]int, error) {
+	switch EdgeFormat(v) {
+	case EdgesVarint:
+		return unvarints(v[1:])
+	case EdgesVarintDeflate:
+		body, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(v[1:])))
+		if err != nil {
+			return nil, err
+		}
+		return unvarints(body)
+	}
+	ids := []int{}
+	if len(v) == 0 || string(v) == "null" {
+		return ids, nil
+	}
+	for _, s := range strings.Split(string(v), ",") {
+		if id, err := strconv.Atoi(s); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func unvarints(b []byte) ([]int, error) {
+	n, read := binary.Uvarint(b)
+	if read <= 0 || n > uint64(len(b)) {
+		return nil, ErrBadEdges
+	}
+	b = b[read:]
+	ids := make([]int, 0, n)
+	prev := 0
+	for i := uint64(0); i < n; i++ {
+		delta, read := binary.Varint(b)
+		if read <= 0 {
+			return nil, ErrBadEdges
+		}
+		b = b[read:]
+		prev += int(delta)
+		ids = append(ids, prev)
+	}
+	return ids, nil
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEdgeDiff(t *testing.T) {
+	tests := []struct {
+		name           string
+		old, new       []int
+		added, removed []int
+	}{
+		{"first crawl", nil, []int{1, 2}, []int{1, 2}, nil},
+		{"nothing changed", []int{1, 2}, []int{2, 1}, nil, nil},
+		{"one in one out", []int{1, 2}, []int{2, 3}, []int{3}, []int{1}},
+		{"emptied", []int{1, 2}, nil, nil, []int{1, 2}},
+		{"duplicates count once", []int{1, 1, 2}, []int{3, 3, 2}, []int{3}, []int{1}},
+	}
+	for _, test := range tests {
+		added, removed := EdgeDiff(test.old, test.new)
+		if !reflect.DeepEqual(added, test.added) || !reflect.DeepEqual(removed, test.removed) {
+			t.Errorf("%s: added %v removed %v, want %v and %v", test.name, added, removed, test.added, test.removed)
+		}
+	}
+}
+
+func TestEdgesRoundTrip(t *testing.T) {
+	tests := []struct {
+		edge string
+		ids  []int
+		// Only playlists keep their order, the other lists come back sorted from the varint formats
+		sorted []int
+	}{
+		{TrackFavoriters, []int{30, 10, 20}, []int{10, 20, 30}},
+		{PlaylistTracks, []int{30, 10, 20}, []int{30, 10, 20}},
+		{TrackCommenters, []int{}, []int{}},
+		{TrackFavoriters, []int{1 << 40, 5}, []int{5, 1 << 40}},
+	}
+	for _, test := range tests {
+		for _, format := range []string{"", EdgesCSV, EdgesVarint, EdgesVarintDeflate} {
+			v, err := EncodeEdges(test.edge, test.ids, format)
+			if err != nil {
+				t.Fatalf("%s %q: %v", test.edge, format, err)
+			}
+			if format != "" && EdgeFormat(v) != format {
+				t.Errorf("%s %q is read back as %q", test.edge, format, EdgeFormat(v))
+			}
+			ids, err := DecodeEdges(v)
+			if err != nil {
+				t.Fatalf("%s %q: %v", test.edge, format, err)
+			}
+			want := test.sorted
+			if format == "" || format == EdgesCSV {
+				want = test.ids
+			}
+			if !reflect.DeepEqual(ids, want) {
+				t.Errorf("%s %q: got %v, want %v", test.edge, format, ids, want)
+			}
+		}
+	}
+}
+
+func TestDecodeEdges(t *testing.T) {
+	tests := []struct {
+		v   string
+		ids []int
+		err error
+	}{
+		{"", []int{}, nil},
+		{"null", []int{}, nil},
+		{"1,2,3", []int{1, 2, 3}, nil},
+		{"\x01\x05\x02", nil, ErrBadEdges},
+		{"\x01", nil, ErrBadEdges},
+	}
+	for _, test := range tests {
+		ids, err := DecodeEdges([]byte(test.v))
+		if err != test.err || !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%q: got %v (%v), want %v (%v)", test.v, ids, err, test.ids, test.err)
+		}
+	}
+}
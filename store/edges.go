@@ -0,0 +1,74 @@
+package store
+
+// Every edge list keeps a counter up to date. For commenters and favoriters the counter belongs to
+// the track itself (how many users commented on it). For playlists it belongs to every track in the
+// playlist (how many playlists the track is in).
+var edgeCounters = map[string]struct {
+	Counter   string
+	PerMember bool
+}{
+	TrackCommenters: {TrackCountCommenters, false},
+	TrackFavoriters: {TrackCountFavoriters, false},
+	PlaylistTracks:  {TrackCountPlaylist, true},
+}
+
+// The edge lists that the ids of a kind own
+var kindEdges = map[string][]string{
+	Tracks:    {TrackCommenters, TrackFavoriters},
+	Playlists: {PlaylistTracks},
+}
+
+func KindEdges(kind string) []string {
+	return kindEdges[kind]
+}
+
+// Adds a whole list to the counter of its edge (by 1) or takes it out again (by -1) with incr.
+// Duplicates only count once, same as in PutEdges.
+func CountEdgeList(edge string, id int, ids []int, by int, incr func(counter string, id, by int) error) error {
+	counter, perMember := EdgeCounter(edge)
+	unique, _ := EdgeDiff(nil, ids)
+	if !perMember {
+		if len(unique) == 0 {
+			return nil
+		}
+		return incr(counter, id, by*len(unique))
+	}
+	for _, member := range unique {
+		if err := incr(counter, member, by); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The counter that an edge list keeps up to date and whether it is kept per member of the list
+// instead of for the id that owns the list.
+func EdgeCounter(edge string) (string, bool) {
+	c, ok := edgeCounters[edge]
+	if !ok {
+		return "", false
+	}
+	return c.Counter, c.PerMember
+}
+
+// Which ids are new in the list and which ones are gone. Duplicates only count once.
+func EdgeDiff(old, new []int) (added, removed []int) {
+	before := make(map[int]bool, len(old))
+	for _, id := range old {
+		before[id] = true
+	}
+	after := make(map[int]bool, len(new))
+	for _, id := range new {
+		if !after[id] && !before[id] {
+			added = append(added, id)
+		}
+		after[id] = true
+	}
+	for _, id := range old {
+		if before[id] && !after[id] {
+			removed = append(removed, id)
+			before[id] = false
+		}
+	}
+	return added, removed
+}
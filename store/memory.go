@@ -0,0 +1,237 @@
+package store
+
+import (
+	"github.com/Abramovic/soundclouder/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the whole graph in maps. It's meant for tests and small experiments where
+// nothing has to survive the process. One MemoryStore can be shared by all of the workers (see
+// Crawler.UseGraph).
+type MemoryStore struct {
+	mu       sync.Mutex
+	state    map[string]map[int]bool // kind -> id -> crawled yet
+	tracks   map[int]models.Track
+	users    map[int]models.UserPreview
+	edges    map[string]map[int][]int
+	counters map[string]map[int]int
+	last     map[string]map[int]time.Time
+	next     map[string]map[int]time.Time
+	dead     map[string]map[int]Tombstone
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		state:    map[string]map[int]bool{},
+		tracks:   map[int]models.Track{},
+		users:    map[int]models.UserPreview{},
+		edges:    map[string]map[int][]int{},
+		counters: map[string]map[int]int{},
+		last:     map[string]map[int]time.Time{},
+		next:     map[string]map[int]time.Time{},
+		dead:     map[string]map[int]Tombstone{},
+	}
+}
+
+func (m *MemoryStore) AddPending(kind string, ids []int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state[kind] == nil {
+		m.state[kind] = map[int]bool{}
+	}
+	added := 0
+	for _, id := range ids {
+		if _, ok := m.state[kind][id]; ok {
+			continue
+		}
+		m.state[kind][id] = false
+		added++
+	}
+	return added, nil
+}
+
+func (m *MemoryStore) Ids(kind string, first, last int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := []int{}
+	for id := range m.state[kind] {
+		if id >= first && id <= last {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (m *MemoryStore) IsPending(kind string, id int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.state[kind][id]
+	return ok, nil
+}
+
+func (m *MemoryStore) MarkDead(kind string, id int, reason string, at time.Time) (Tombstone, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dead[kind] == nil {
+		m.dead[kind] = map[int]Tombstone{}
+	}
+	old, buried := m.dead[kind][id]
+	t := Bury(old, buried, reason, m.state[kind][id], at)
+	m.dead[kind][id] = t
+	delete(m.next[kind], id)
+	return t, nil
+}
+
+func (m *MemoryStore) Tombstone(kind string, id int) (Tombstone, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.dead[kind][id]
+	return t, ok, nil
+}
+
+func (m *MemoryStore) PutTrack(track *models.Track) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state[Tracks] == nil {
+		m.state[Tracks] = map[int]bool{}
+	}
+	m.state[Tracks][track.Id] = true
+	delete(m.dead[Tracks], track.Id)
+	m.tracks[track.Id] = *track
+	return nil
+}
+
+func (m *MemoryStore) PutUser(user models.UserPreview) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[user.Id]; ok {
+		return false, nil
+	}
+	m.users[user.Id] = user
+	return true, nil
+}
+
+func (m *MemoryStore) PutEdges(edge string, id int, ids []int) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.edges[edge] == nil {
+		m.edges[edge] = map[int][]int{}
+	}
+	added, removed := EdgeDiff(m.edges[edge][id], ids)
+	m.edges[edge][id] = append([]int{}, ids...)
+	if edge == PlaylistTracks {
+		if m.state[Playlists] == nil {
+			m.state[Playlists] = map[int]bool{}
+		}
+		m.state[Playlists][id] = true
+		delete(m.dead[Playlists], id)
+	}
+	counter, perMember := EdgeCounter(edge)
+	if m.counters[counter] == nil {
+		m.counters[counter] = map[int]int{}
+	}
+	if perMember {
+		for _, member := range added {
+			m.counters[counter][member]++
+		}
+		for _, member := range removed {
+			m.counters[counter][member]--
+		}
+	} else {
+		m.counters[counter][id] += len(added) - len(removed)
+	}
+	return len(added), len(removed), nil
+}
+
+func (m *MemoryStore) CountEdges(edge string, id, by int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return CountEdgeList(edge, id, m.edges[edge][id], by, func(counter string, id, by int) error {
+		if m.counters[counter] == nil {
+			m.counters[counter] = map[int]int{}
+		}
+		m.counters[counter][id] += by
+		return nil
+	})
+}
+
+func (m *MemoryStore) IncrementCounter(counter string, id, by int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters[counter] == nil {
+		m.counters[counter] = map[int]int{}
+	}
+	m.counters[counter][id] += by
+	return nil
+}
+
+func (m *MemoryStore) MarkCrawled(kind string, id int, at, next time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.last[kind] == nil {
+		m.last[kind] = map[int]time.Time{}
+		m.next[kind] = map[int]time.Time{}
+	}
+	m.last[kind][id] = at
+	m.next[kind][id] = next
+	return nil
+}
+
+func (m *MemoryStore) NextCrawl(kind string, id int) (time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next, ok := m.next[kind][id]
+	return next, ok, nil
+}
+
+func (m *MemoryStore) EarliestNextCrawl(kind string, first, last int) (time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var earliest time.Time
+	found := false
+	for id, next := range m.next[kind] {
+		if id < first || id > last {
+			continue
+		}
+		if !found || next.Before(earliest) {
+			earliest, found = next, true
+		}
+	}
+	return earliest, found, nil
+}
+
+func (m *MemoryStore) Flush() error {
+	return nil
+}
+
+// Nothing to close, everything is gone once the process exits.
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) CloseFile() error {
+	return nil
+}
+
+// Lets a test look at what the workers stored.
+func (m *MemoryStore) Track(id int) (models.Track, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tracks[id]
+	return t, ok
+}
+
+func (m *MemoryStore) Edges(edge string, id int) []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.edges[edge][id]
+}
+
+func (m *MemoryStore) Counter(counter string, id int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[counter][id]
+}
@@ -0,0 +1,527 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/Abramovic/soundclouder/models"
+	_ "github.com/mattn/go-sqlite3"
+	"sync"
+	"time"
+)
+
+// The schema is normalized so a crawl can be queried with plain SQL. crawl_state is the list of
+// every id we know about, dead ones have a row in tombstones too. The edge tables have one row per
+// edge and are indexed both ways.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS crawl_state (
+		kind       TEXT    NOT NULL,
+		id         INTEGER NOT NULL,
+		crawled    INTEGER NOT NULL DEFAULT 0,
+		last_crawl INTEGER,
+		next_crawl INTEGER,
+		PRIMARY KEY (kind, id)
+	) WITHOUT ROWID`,
+	`CREATE TABLE IF NOT EXISTS tombstones (
+		kind    TEXT    NOT NULL,
+		id      INTEGER NOT NULL,
+		reason  TEXT    NOT NULL,
+		since   INTEGER NOT NULL,
+		checked INTEGER NOT NULL,
+		checks  INTEGER NOT NULL,
+		PRIMARY KEY (kind, id)
+	) WITHOUT ROWID`,
+	`CREATE TABLE IF NOT EXISTS tracks (
+		id                INTEGER PRIMARY KEY,
+		user_id           INTEGER,
+		title             TEXT,
+		created_at        TEXT,
+		duration          INTEGER,
+		genre             TEXT,
+		tag_list          TEXT,
+		permalink_url     TEXT,
+		playback_count    INTEGER,
+		download_count    INTEGER,
+		favoritings_count INTEGER,
+		comment_count     INTEGER,
+		data              TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS tracks_user_id ON tracks (user_id)`,
+	`CREATE TABLE IF NOT EXISTS users (
+		id            INTEGER PRIMARY KEY,
+		permalink     TEXT,
+		uri           TEXT,
+		permalink_url TEXT,
+		avatar_url    TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS playlists (
+		id          INTEGER PRIMARY KEY,
+		track_count INTEGER
+	)`,
+	`CREATE TABLE IF NOT EXISTS favorites (
+		track_id INTEGER NOT NULL,
+		user_id  INTEGER NOT NULL,
+		PRIMARY KEY (track_id, user_id)
+	) WITHOUT ROWID`,
+	`CREATE INDEX IF NOT EXISTS favorites_user_id ON favorites (user_id)`,
+	`CREATE TABLE IF NOT EXISTS comments (
+		track_id INTEGER NOT NULL,
+		user_id  INTEGER NOT NULL,
+		PRIMARY KEY (track_id, user_id)
+	) WITHOUT ROWID`,
+	`CREATE INDEX IF NOT EXISTS comments_user_id ON comments (user_id)`,
+	`CREATE TABLE IF NOT EXISTS playlist_tracks (
+		playlist_id INTEGER NOT NULL,
+		track_id    INTEGER NOT NULL,
+		position    INTEGER NOT NULL,
+		PRIMARY KEY (playlist_id, track_id)
+	) WITHOUT ROWID`,
+	`CREATE INDEX IF NOT EXISTS playlist_tracks_track_id ON playlist_tracks (track_id)`,
+	`CREATE TABLE IF NOT EXISTS track_counts (
+		track_id   INTEGER PRIMARY KEY,
+		playlists  INTEGER NOT NULL DEFAULT 0,
+		commenters INTEGER NOT NULL DEFAULT 0,
+		favoriters INTEGER NOT NULL DEFAULT 0
+	)`,
+}
+
+// Which table holds which edge list and which column of track_counts holds which counter
+var (
+	edgeTables = map[string]string{
+		TrackCommenters: "comments",
+		TrackFavoriters: "favorites",
+	}
+	counterColumns = map[string]string{
+		TrackCountPlaylist:   "playlists",
+		TrackCountCommenters: "commenters",
+		TrackCountFavoriters: "favoriters",
+	}
+)
+
+// SQLiteStore writes the graph into a local SQLite file. SQLite only has one writer at a time so
+// instead of a transaction per write every worker goes through one open transaction that is
+// committed every BatchWrites writes or every BatchInterval, whichever comes first. A crash loses
+// at most the last batch, which is crawled again since the ids are still pending.
+type SQLiteStore struct {
+	BatchWrites   int
+	BatchInterval time.Duration
+
+	mu     sync.Mutex
+	db     *sql.DB
+	tx     *sql.Tx
+	writes int
+	done   chan struct{}
+	// Set once a batch failed to commit. The writes of every worker in it are gone and we can't
+	// tell whose they were, so from then on Flush fails for everyone and the workers stop.
+	err error
+}
+
+// Returned by Flush once a commit failed. None of the batches in progress can be acked, so the
+// crawl has to stop and be restarted, which crawls them again.
+var ErrCommitFailed = errors.New("sqlite commit failed, the writes since the last commit are lost")
+
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=10000&_synchronous=NORMAL")
+	if err != nil {
+		return nil, err
+	}
+	// Everything goes through the one transaction anyway
+	db.SetMaxOpenConns(1)
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	s := &SQLiteStore{
+		BatchWrites:   1000,
+		BatchInterval: time.Second,
+		db:            db,
+		done:          make(chan struct{}),
+	}
+	go s.commitEvery()
+	return s, nil
+}
+
+func (s *SQLiteStore) commitEvery() {
+	ticker := time.NewTicker(s.BatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			// Nobody is waiting for this one, Flush reports it
+			s.commit()
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Has to be called with mu held
+func (s *SQLiteStore) commit() error {
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Commit()
+	s.tx, s.writes = nil, 0
+	if err != nil {
+		s.err = ErrCommitFailed
+	}
+	return err
+}
+
+// Runs fn inside of the current batch. Every write gets a savepoint so a failed write is undone
+// without throwing away the writes of the other workers. Writes count towards BatchWrites.
+func (s *SQLiteStore) do(write bool, fn func(tx *sql.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		s.tx = tx
+	}
+	if !write {
+		return fn(s.tx)
+	}
+	if _, err := s.tx.Exec(`SAVEPOINT write`); err != nil {
+		return err
+	}
+	if err := fn(s.tx); err != nil {
+		s.tx.Exec(`ROLLBACK TO write`)
+		s.tx.Exec(`RELEASE write`)
+		return err
+	}
+	if _, err := s.tx.Exec(`RELEASE write`); err != nil {
+		return err
+	}
+	s.writes++
+	if s.writes >= s.BatchWrites {
+		return s.commit()
+	}
+	return nil
+}
+
+func (s *SQLiteStore) AddPending(kind string, ids []int) (int, error) {
+	added := 0
+	err := s.do(true, func(tx *sql.Tx) error {
+		added = 0
+		stmt, err := tx.Prepare(`INSERT OR IGNORE INTO crawl_state (kind, id) VALUES (?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, id := range ids {
+			res, err := stmt.Exec(kind, id)
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			added += int(n)
+		}
+		return nil
+	})
+	return added, err
+}
+
+func (s *SQLiteStore) Ids(kind string, first, last int) ([]int, error) {
+	ids := []int{}
+	err := s.do(false, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT id FROM crawl_state WHERE kind = ? AND id BETWEEN ? AND ? ORDER BY id`, kind, first, last)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return rows.Err()
+	})
+	return ids, err
+}
+
+func (s *SQLiteStore) IsPending(kind string, id int) (bool, error) {
+	found := false
+	err := s.do(false, func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM crawl_state WHERE kind = ? AND id = ?`, kind, id).Scan(&n)
+		found = n > 0
+		return err
+	})
+	return found, err
+}
+
+// The track or playlist rows stay so we still know what a deleted track was
+func (s *SQLiteStore) MarkDead(kind string, id int, reason string, at time.Time) (Tombstone, error) {
+	var t Tombstone
+	err := s.do(true, func(tx *sql.Tx) error {
+		old, buried, err := tombstone(tx, kind, id)
+		if err != nil {
+			return err
+		}
+		var crawled int
+		err = tx.QueryRow(`SELECT crawled FROM crawl_state WHERE kind = ? AND id = ?`, kind, id).Scan(&crawled)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		t = Bury(old, buried, reason, crawled == 1, at)
+		_, err = tx.Exec(`INSERT OR REPLACE INTO tombstones (kind, id, reason, since, checked, checks)
+			VALUES (?, ?, ?, ?, ?, ?)`, kind, id, t.Reason, t.Since.Unix(), t.Checked.Unix(), t.Checks)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE crawl_state SET next_crawl = NULL WHERE kind = ? AND id = ?`, kind, id)
+		return err
+	})
+	return t, err
+}
+
+func tombstone(tx *sql.Tx, kind string, id int) (Tombstone, bool, error) {
+	var reason string
+	var since, checked int64
+	var checks int
+	err := tx.QueryRow(`SELECT reason, since, checked, checks FROM tombstones WHERE kind = ? AND id = ?`,
+		kind, id).Scan(&reason, &since, &checked, &checks)
+	if err == sql.ErrNoRows {
+		return Tombstone{}, false, nil
+	}
+	if err != nil {
+		return Tombstone{}, false, err
+	}
+	return Tombstone{Reason: reason, Since: time.Unix(since, 0), Checked: time.Unix(checked, 0), Checks: checks}, true, nil
+}
+
+func (s *SQLiteStore) Tombstone(kind string, id int) (Tombstone, bool, error) {
+	var t Tombstone
+	ok := false
+	err := s.do(false, func(tx *sql.Tx) error {
+		var err error
+		t, ok, err = tombstone(tx, kind, id)
+		return err
+	})
+	return t, ok, err
+}
+
+// Storing something for an id means it's alive, so it loses its tombstone
+func markCrawled(tx *sql.Tx, kind string, id int) error {
+	_, err := tx.Exec(`INSERT INTO crawl_state (kind, id, crawled) VALUES (?, ?, 1)
+		ON CONFLICT (kind, id) DO UPDATE SET crawled = 1`, kind, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM tombstones WHERE kind = ? AND id = ?`, kind, id)
+	return err
+}
+
+func (s *SQLiteStore) PutTrack(track *models.Track) error {
+	j, err := json.Marshal(track)
+	if err != nil {
+		return err
+	}
+	return s.do(true, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT OR REPLACE INTO tracks (id, user_id, title, created_at, duration, genre,
+			tag_list, permalink_url, playback_count, download_count, favoritings_count, comment_count, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			track.Id, track.UserId, track.Title, track.CreatedAt, track.Duration, track.Genre,
+			track.TagList, track.PermalinkURL, track.PlaybackCount, track.DownloadCount,
+			track.FavoritingsCount, track.CommentCount, string(j))
+		if err != nil {
+			return err
+		}
+		return markCrawled(tx, Tracks, track.Id)
+	})
+}
+
+func (s *SQLiteStore) PutUser(user models.UserPreview) (bool, error) {
+	added := false
+	err := s.do(true, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`INSERT OR IGNORE INTO users (id, permalink, uri, permalink_url, avatar_url)
+			VALUES (?, ?, ?, ?, ?)`, user.Id, user.Permalink, user.URI, user.PermalinkURL, user.AvatarURL)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		added = n > 0
+		return nil
+	})
+	return added, err
+}
+
+// The edge list replaces whatever was stored for the id before and the counters move by the
+// difference. Everything happens inside of the current transaction so it is atomic.
+func (s *SQLiteStore) PutEdges(edge string, id int, ids []int) (int, int, error) {
+	var added, removed []int
+	err := s.do(true, func(tx *sql.Tx) error {
+		table, owner, member := edgeTable(edge)
+		old, err := edgeIds(tx, `SELECT `+member+` FROM `+table+` WHERE `+owner+` = ?`, id)
+		if err != nil {
+			return err
+		}
+		added, removed = EdgeDiff(old, ids)
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE `+owner+` = ?`, id); err != nil {
+			return err
+		}
+		insert := `INSERT OR IGNORE INTO ` + table + ` (track_id, user_id) VALUES (?, ?)`
+		if edge == PlaylistTracks {
+			insert = `INSERT OR IGNORE INTO playlist_tracks (playlist_id, track_id, position) VALUES (?, ?, ?)`
+		}
+		stmt, err := tx.Prepare(insert)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for i, other := range ids {
+			args := []interface{}{id, other}
+			if edge == PlaylistTracks {
+				args = append(args, i)
+			}
+			if _, err := stmt.Exec(args...); err != nil {
+				return err
+			}
+		}
+
+		counter, perMember := EdgeCounter(edge)
+		if perMember {
+			for _, other := range added {
+				if err := sqlIncr(tx, counter, other, 1); err != nil {
+					return err
+				}
+			}
+			for _, other := range removed {
+				if err := sqlIncr(tx, counter, other, -1); err != nil {
+					return err
+				}
+			}
+		} else if len(added) != len(removed) {
+			if err := sqlIncr(tx, counter, id, len(added)-len(removed)); err != nil {
+				return err
+			}
+		}
+		if edge == PlaylistTracks {
+			if _, err := tx.Exec(`INSERT OR REPLACE INTO playlists (id, track_count) VALUES (?, ?)`, id, len(ids)); err != nil {
+				return err
+			}
+			return markCrawled(tx, Playlists, id)
+		}
+		return nil
+	})
+	return len(added), len(removed), err
+}
+
+func edgeIds(tx *sql.Tx, query string, args ...interface{}) ([]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLiteStore) CountEdges(edge string, id, by int) error {
+	return s.do(true, func(tx *sql.Tx) error {
+		table, owner, member := edgeTable(edge)
+		ids, err := edgeIds(tx, `SELECT `+member+` FROM `+table+` WHERE `+owner+` = ?`, id)
+		if err != nil {
+			return err
+		}
+		return CountEdgeList(edge, id, ids, by, func(counter string, id, by int) error {
+			return sqlIncr(tx, counter, id, by)
+		})
+	})
+}
+
+// The table of an edge and its columns for the id that owns the list and for the members
+func edgeTable(edge string) (table, owner, member string) {
+	if edge == PlaylistTracks {
+		return "playlist_tracks", "playlist_id", "track_id"
+	}
+	return edgeTables[edge], "track_id", "user_id"
+}
+
+func sqlIncr(tx *sql.Tx, counter string, id, by int) error {
+	column := counterColumns[counter]
+	_, err := tx.Exec(`INSERT INTO track_counts (track_id, `+column+`) VALUES (?, ?)
+		ON CONFLICT (track_id) DO UPDATE SET `+column+` = `+column+` + excluded.`+column, id, by)
+	return err
+}
+
+func (s *SQLiteStore) IncrementCounter(counter string, id, by int) error {
+	return s.do(true, func(tx *sql.Tx) error {
+		return sqlIncr(tx, counter, id, by)
+	})
+}
+func (s *SQLiteStore) MarkCrawled(kind string, id int, at, next time.Time) error {
+	return s.do(true, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE crawl_state SET last_crawl = ?, next_crawl = ? WHERE kind = ? AND id = ?`,
+			at.Unix(), next.Unix(), kind, id)
+		return err
+	})
+}
+
+func (s *SQLiteStore) NextCrawl(kind string, id int) (time.Time, bool, error) {
+	var next sql.NullInt64
+	err := s.do(false, func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT next_crawl FROM crawl_state WHERE kind = ? AND id = ?`, kind, id).Scan(&next)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	if err != nil || !next.Valid {
+		return time.Time{}, false, err
+	}
+	return time.Unix(next.Int64, 0), true, nil
+}
+
+func (s *SQLiteStore) EarliestNextCrawl(kind string, first, last int) (time.Time, bool, error) {
+	var next sql.NullInt64
+	err := s.do(false, func(tx *sql.Tx) error {
+		return tx.QueryRow(`SELECT MIN(next_crawl) FROM crawl_state WHERE kind = ? AND id BETWEEN ? AND ?`,
+			kind, first, last).Scan(&next)
+	})
+	if err != nil || !next.Valid {
+		return time.Time{}, false, err
+	}
+	return time.Unix(next.Int64, 0), true, nil
+}
+
+// Commits the current batch of writes. Returns ErrCommitFailed from the first commit that failed
+// on, the workers stop on it and the restart picks the lost batches up again.
+func (s *SQLiteStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commit()
+	return s.err
+}
+
+// The file stays open for the other workers. Use CloseFile once the crawl is done.
+func (s *SQLiteStore) Close() error {
+	return nil
+}
+
+// Commits whatever is left in the current batch and closes the file
+func (s *SQLiteStore) CloseFile() error {
+	close(s.done)
+	s.mu.Lock()
+	err := s.commit()
+	s.mu.Unlock()
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
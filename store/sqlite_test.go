@@ -0,0 +1,65 @@
+package store
+
+import (
+	"database/sql"
+	"github.com/Abramovic/soundclouder/models"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The point of the SQLite store is that a crawl can be read with plain SQL
+func TestSQLiteTables(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crawl.sqlite")
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PutTrack(&models.Track{Id: 1, Title: "one", UserId: 7})
+	if added, err := s.PutUser(models.UserPreview{Id: 7, Permalink: "seven"}); !added || err != nil {
+		t.Errorf("user 7 wasn't added (%v)", err)
+	}
+	if added, _ := s.PutUser(models.UserPreview{Id: 7, Permalink: "later"}); added {
+		t.Errorf("user 7 was stored twice")
+	}
+	s.PutEdges(TrackFavoriters, 1, []int{8, 7})
+	s.PutEdges(PlaylistTracks, 5, []int{3, 1, 2})
+	if err := s.CloseFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{`SELECT title FROM tracks WHERE id = 1`, []string{"one"}},
+		{`SELECT permalink FROM users WHERE id = 7`, []string{"seven"}},
+		{`SELECT user_id FROM favorites WHERE track_id = 1 ORDER BY user_id`, []string{"7", "8"}},
+		{`SELECT track_id FROM favorites WHERE user_id = 8`, []string{"1"}},
+		{`SELECT track_id FROM playlist_tracks WHERE playlist_id = 5 ORDER BY position`, []string{"3", "1", "2"}},
+		{`SELECT track_count FROM playlists WHERE id = 5`, []string{"3"}},
+		{`SELECT favoriters FROM track_counts WHERE track_id = 1`, []string{"2"}},
+		{`SELECT crawled FROM crawl_state WHERE kind = 'playlists' AND id = 5`, []string{"1"}},
+	}
+	for _, test := range tests {
+		rows, err := db.Query(test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		got := []string{}
+		for rows.Next() {
+			var v string
+			rows.Scan(&v)
+			got = append(got, v)
+		}
+		rows.Close()
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.query, got, test.want)
+		}
+	}
+}
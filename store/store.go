@@ -0,0 +1,85 @@
+package store
+
+import (
+	"github.com/Abramovic/soundclouder/models"
+	"time"
+)
+
+// What we crawl. Every id of a kind is either pending (never crawled), crawled or dead (it has a
+// tombstone).
+const (
+	Tracks    = "tracks"
+	Playlists = "playlists"
+)
+
+// Edge lists that hang off of a track or playlist
+const (
+	TrackCommenters = "trackCommenters"
+	TrackFavoriters = "trackFavoriters"
+	PlaylistTracks  = "playlistTracks"
+)
+
+// Counters that are kept per track
+const (
+	TrackCountPlaylist   = "trackCountPlaylist"
+	TrackCountCommenters = "trackCountCommenters"
+	TrackCountFavoriters = "trackCountFavoriters"
+)
+
+// A GraphStore is everything the workers need to know about tracks, users and the edges between
+// them. The workers only ever talk to a GraphStore so where the graph lives (Redis hashes, a file
+// on disk, memory in a test) doesn't matter to them. Coordination between workers (queues, the
+// schedule, control messages) is not part of it.
+//
+// A GraphStore is used by one worker at a time. Open a new one for every worker.
+type GraphStore interface {
+	// Adds ids we have never seen as pending. Ids we already know about (even dead ones) are left
+	// alone. Returns how many ids were added.
+	AddPending(kind string, ids []int) (int, error)
+	// The ids between first and last (one batch) that we know about, dead ones included.
+	Ids(kind string, first, last int) ([]int, error)
+	// True if we know about the id. Ids we never saw are not pending, dead ones still are (use
+	// Tombstone to tell them apart).
+	IsPending(kind string, id int) (bool, error)
+	// The id doesn't exist (or isn't public). It gets a tombstone (see Bury for how the reason
+	// and times are worked out) and its next crawl is dropped, but whatever was stored for it is
+	// kept. Storing a track or playlist again removes the tombstone.
+	MarkDead(kind string, id int, reason string, at time.Time) (Tombstone, error)
+	// ok is false if the id isn't dead
+	Tombstone(kind string, id int) (t Tombstone, ok bool, err error)
+
+	PutTrack(track *models.Track) error
+	// Only the first version of a user we see is stored. Returns true if the user was new, a store
+	// that queues its writes (RedisStore) can't tell yet and returns false.
+	PutUser(user models.UserPreview) (bool, error)
+	// Replaces the edge list of an id and moves the counter of the edge (see EdgeCounter) by the
+	// difference to the list that was stored before, all in one atomic step, so crawling the same
+	// id twice never counts its edges twice. Returns how many edges were added and removed.
+	// Storing PlaylistTracks marks the playlist as crawled.
+	PutEdges(edge string, id int, ids []int) (added, removed int, err error)
+	IncrementCounter(counter string, id, by int) error
+	// The counters only count the lists of live ids. Takes the stored list of an id out of the
+	// counter of its edge (by -1) when the id dies and puts it back in (by 1) when it comes back,
+	// without changing the list itself.
+	CountEdges(edge string, id, by int) error
+
+	// When an id was crawled and when it is due to be crawled again (continuous mode)
+	MarkCrawled(kind string, id int, at, next time.Time) error
+	// The time is zero and ok is false if the id was never crawled.
+	NextCrawl(kind string, id int) (next time.Time, ok bool, err error)
+	// The earliest next crawl of the ids between first and last. ok is false if none were crawled.
+	EarliestNextCrawl(kind string, first, last int) (next time.Time, ok bool, err error)
+
+	// Writes may be buffered. Flush returns once everything written so far is stored, so call it
+	// before a batch is acked.
+	Flush() error
+	Close() error
+}
+
+// A GraphStore that lives in a local file is opened once and shared by every worker of the
+// process. Close does nothing for those so a worker can't close it for everyone else, CloseFile
+// closes it for good.
+type SharedStore interface {
+	GraphStore
+	CloseFile() error
+}
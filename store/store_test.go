@@ -0,0 +1,191 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"github.com/Abramovic/soundclouder/models"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Every GraphStore that runs without Redis, each in a file of its own
+func testStores(t *testing.T) map[string]SharedStore {
+	dir := t.TempDir()
+	b, err := OpenBolt(filepath.Join(dir, "crawl.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSQLite(filepath.Join(dir, "crawl.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.CloseFile()
+		s.CloseFile()
+	})
+	return map[string]SharedStore{"memory": NewMemoryStore(), "bolt": b, "sqlite": s}
+}
+
+// Reads a counter straight out of the store
+func counter(t *testing.T, g GraphStore, name string, id int) int {
+	n := 0
+	var err error
+	switch g := g.(type) {
+	case *MemoryStore:
+		n = g.Counter(name, id)
+	case *BoltStore:
+		err = g.db.View(func(tx *bolt.Tx) error {
+			if counters := tx.Bucket([]byte(name)); counters != nil {
+				if v := counters.Get(idKey(id)); len(v) == 8 {
+					n = int(binary.BigEndian.Uint64(v))
+				}
+			}
+			return nil
+		})
+	case *SQLiteStore:
+		err = g.do(false, func(tx *sql.Tx) error {
+			err := tx.QueryRow(`SELECT `+counterColumns[name]+` FROM track_counts WHERE track_id = ?`, id).Scan(&n)
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return err
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPending(t *testing.T) {
+	for name, g := range testStores(t) {
+		if n, err := g.AddPending(Tracks, []int{2, 1, 1500}); err != nil || n != 3 {
+			t.Errorf("%s: added %d (%v), want 3", name, n, err)
+		}
+		if n, err := g.AddPending(Tracks, []int{1, 3}); err != nil || n != 1 {
+			t.Errorf("%s: added %d (%v) again, want only 3", name, n, err)
+		}
+		if ids, err := g.Ids(Tracks, 0, 999); err != nil || !reflect.DeepEqual(ids, []int{1, 2, 3}) {
+			t.Errorf("%s: batch 0 is %v (%v), want 1, 2 and 3", name, ids, err)
+		}
+		tests := []struct {
+			kind    string
+			id      int
+			pending bool
+		}{
+			{Tracks, 1, true},
+			{Tracks, 1500, true},
+			{Tracks, 4, false},
+			{Playlists, 1, false},
+		}
+		for _, test := range tests {
+			if pending, err := g.IsPending(test.kind, test.id); err != nil || pending != test.pending {
+				t.Errorf("%s: %s %d pending is %v (%v), want %v", name, test.kind, test.id, pending, err, test.pending)
+			}
+		}
+	}
+}
+
+func TestEdgeCounters(t *testing.T) {
+	steps := []struct {
+		edge           string
+		id             int
+		ids            []int
+		added, removed int
+		// counter -> id -> value after the step
+		counters map[string]map[int]int
+	}{
+		{TrackFavoriters, 1, []int{7, 8, 8}, 2, 0, map[string]map[int]int{TrackCountFavoriters: {1: 2}}},
+		{TrackFavoriters, 1, []int{8, 9}, 1, 1, map[string]map[int]int{TrackCountFavoriters: {1: 2}}},
+		{TrackCommenters, 1, []int{7}, 1, 0, map[string]map[int]int{TrackCountCommenters: {1: 1}}},
+		{PlaylistTracks, 5, []int{1, 2}, 2, 0, map[string]map[int]int{TrackCountPlaylist: {1: 1, 2: 1}}},
+		{PlaylistTracks, 6, []int{2}, 1, 0, map[string]map[int]int{TrackCountPlaylist: {1: 1, 2: 2}}},
+		{PlaylistTracks, 5, []int{}, 0, 2, map[string]map[int]int{TrackCountPlaylist: {1: 0, 2: 1}}},
+	}
+	for name, g := range testStores(t) {
+		for i, step := range steps {
+			added, removed, err := g.PutEdges(step.edge, step.id, step.ids)
+			if err != nil || added != step.added || removed != step.removed {
+				t.Errorf("%s step %d: added %d removed %d (%v), want %d and %d", name, i, added, removed, err, step.added, step.removed)
+			}
+			for c, ids := range step.counters {
+				for id, want := range ids {
+					if got := counter(t, g, c, id); got != want {
+						t.Errorf("%s step %d: %s %d is %d, want %d", name, i, c, id, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestTombstonesAndCounts(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	for name, g := range testStores(t) {
+		g.AddPending(Playlists, []int{5})
+		g.PutEdges(PlaylistTracks, 5, []int{1, 2})
+		if _, ok, err := g.Tombstone(Playlists, 5); err != nil || ok {
+			t.Errorf("%s: playlist 5 is dead before it was buried (%v)", name, err)
+		}
+		ts, err := g.MarkDead(Playlists, 5, DeadPrivate, now)
+		if err != nil || ts.Reason != DeadPrivate {
+			t.Errorf("%s: buried as %+v (%v)", name, ts, err)
+		}
+		if ts, ok, err := g.Tombstone(Playlists, 5); err != nil || !ok || ts.Reason != DeadPrivate {
+			t.Errorf("%s: tombstone is %+v (%v, dead %v)", name, ts, err, ok)
+		}
+		if pending, _ := g.IsPending(Playlists, 5); !pending {
+			t.Errorf("%s: a dead playlist isn't known anymore", name)
+		}
+
+		// What Crawler.Bury and Crawler.Revive do with the counters
+		for _, by := range []int{-1, 1} {
+			if err := g.CountEdges(PlaylistTracks, 5, by); err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if by > 0 {
+				want = 1
+			}
+			for _, id := range []int{1, 2} {
+				if got := counter(t, g, TrackCountPlaylist, id); got != want {
+					t.Errorf("%s: track %d is in %d playlists after counting by %d, want %d", name, id, got, by, want)
+				}
+			}
+		}
+
+		// Storing it again brings it back
+		g.PutEdges(PlaylistTracks, 5, []int{1})
+		if _, ok, _ := g.Tombstone(Playlists, 5); ok {
+			t.Errorf("%s: playlist 5 is still dead after it was stored", name)
+		}
+	}
+}
+
+func TestCrawlTimes(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	for name, g := range testStores(t) {
+		if _, ok, err := g.EarliestNextCrawl(Tracks, 0, 999); err != nil || ok {
+			t.Errorf("%s: a batch that was never crawled has a next crawl (%v)", name, err)
+		}
+		g.PutTrack(&models.Track{Id: 1})
+		g.MarkCrawled(Tracks, 1, now, now.Add(2*time.Hour))
+		g.PutTrack(&models.Track{Id: 2})
+		g.MarkCrawled(Tracks, 2, now, now.Add(time.Hour))
+		if next, ok, err := g.NextCrawl(Tracks, 1); err != nil || !ok || !next.Equal(now.Add(2*time.Hour)) {
+			t.Errorf("%s: track 1 is next crawled at %v (%v)", name, next, err)
+		}
+		if _, ok, _ := g.NextCrawl(Tracks, 3); ok {
+			t.Errorf("%s: track 3 was never crawled but has a next crawl", name)
+		}
+		if next, ok, err := g.EarliestNextCrawl(Tracks, 0, 999); err != nil || !ok || !next.Equal(now.Add(time.Hour)) {
+			t.Errorf("%s: batch 0 is next crawled at %v (%v), want %v", name, next, err, now.Add(time.Hour))
+		}
+		if err := g.Flush(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Why an id is dead. A 404 for an id we never crawled is DeadMissing, a 404 for an id we have data
+// for is DeadDeleted (the store works that out, the workers always say DeadMissing).
+const (
+	DeadMissing = "missing"
+	DeadDeleted = "deleted"
+	DeadPrivate = "private"
+	DeadEmpty   = "empty"
+	DeadBroken  = "broken"
+)
+
+// A Tombstone is what we know about a dead id: why it's dead, when we first found it dead, when
+// we last checked and how many times we checked it since. Whatever was stored for the id before
+// it died is kept.
+type Tombstone struct {
+	Reason  string
+	Since   time.Time
+	Checked time.Time
+	Checks  int
+}
+
+// Stored as "reason:since:checked:checks" with unix timestamps
+func (t Tombstone) String() string {
+	return fmt.Sprintf("%s:%d:%d:%d", t.Reason, t.Since.Unix(), t.Checked.Unix(), t.Checks)
+}
+
+func ParseTombstone(s string) (Tombstone, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 {
+		return Tombstone{}, fmt.Errorf("invalid tombstone %q", s)
+	}
+	var n [3]int64
+	for i, p := range parts[1:] {
+		v, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return Tombstone{}, fmt.Errorf("invalid tombstone %q", s)
+		}
+		n[i] = v
+	}
+	return Tombstone{
+		Reason:  parts[0],
+		Since:   time.Unix(n[0], 0),
+		Checked: time.Unix(n[1], 0),
+		Checks:  int(n[2]),
+	}, nil
+}
+
+// The tombstone after a check at found the id dead. old is the tombstone it had (if buried says
+// it had one) and crawled whether we have data for it from an earlier crawl.
+func Bury(old Tombstone, buried bool, reason string, crawled bool, at time.Time) Tombstone {
+	if reason == DeadMissing && (crawled || buried && old.Reason == DeadDeleted) {
+		reason = DeadDeleted
+	}
+	if !buried {
+		return Tombstone{Reason: reason, Since: at, Checked: at, Checks: 1}
+	}
+	if old.Reason != reason {
+		old.Since = at
+	}
+	old.Reason = reason
+	old.Checked = at
+	old.Checks++
+	return old
+}
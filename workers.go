@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Abramovic/soundclouder/crawler"
+	"os"
+	"text/tabwriter"
+)
+
+// What the heartbeat reports as the state of this worker
+func (c *Crawler) status() string {
+	if stopped() {
+		return "draining"
+	}
+	if c.Concurrency.Paused() {
+		return "paused"
+	}
+	return "running"
+}
+
+// Prints every worker connected to this Redis. Workers that stopped sending heartbeats
+// without exiting cleanly are flagged as SILENT.
+func (c *Crawler) workers() {
+	r := c.RedisClient.Get()
+	defer r.Close()
+	workers, err := crawler.ListWorkers(r)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKER\tSTATUS\tVERSION\tITEMS/SEC\tITEMS\tERRORS\tCONCURRENCY\tBATCHES")
+	for _, worker := range workers {
+		status := worker.Fields["status"]
+		if worker.Silent {
+			status = "SILENT"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			worker.Id,
+			status,
+			worker.Fields["version"],
+			worker.Fields["items_per_sec"],
+			worker.Fields["items"],
+			worker.Fields["errors"],
+			worker.Fields["concurrency"],
+			worker.Fields["batches"],
+		)
+	}
+	w.Flush()
+}